@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/jrxfive/packagetree/pkg/graph"
+	"io"
+	"strings"
+)
+
+const MANIFEST_COMMENT string = "#"
+
+//Single package of a manifest
+type entry struct {
+	name         string
+	dependencies []string
+	line         int
+}
+
+//Reads a manifest, one package per line followed by its dependencies separated by spaces:
+//
+//	#name dependencies...
+//	gmp
+//	isl gmp
+//	app@1.0 libfoo>=1.2,<2 openssl@3
+//
+//Blank lines and lines starting with # are skipped, a package may only be listed once
+func readManifest(r io.Reader) ([]*entry, error) {
+
+	var entries []*entry
+	seen := make(map[string]int)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], MANIFEST_COMMENT) {
+			continue
+		}
+
+		if previous, ok := seen[fields[0]]; ok {
+			return nil, errors.New(fmt.Sprintf("Line %d:%s is already listed on line %d", line, fields[0], previous))
+		}
+		seen[fields[0]] = line
+
+		entries = append(entries, &entry{
+			name:         fields[0],
+			dependencies: fields[1:],
+			line:         line,
+		})
+	}
+
+	return entries, scanner.Err()
+}
+
+//Writes entries in the format read by readManifest
+func writeManifest(w io.Writer, entries []*entry) error {
+	for _, e := range entries {
+		_, err := fmt.Fprintln(w, strings.TrimSpace(e.name+" "+strings.Join(e.dependencies, " ")))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Orders entries so every package comes after the packages of the manifest its dependencies
+//can resolve to, keeping the manifest's order otherwise. Dependencies on packages the manifest
+//doesn't list are left for the server to check. Fails when the manifest's packages depend on
+//each other in a cycle.
+func sortManifest(entries []*entry) ([]*entry, error) {
+
+	versions := make(map[string][]int)
+	for idx, e := range entries {
+		base, _, err := graph.ParsePackage(e.name)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Line %d:%v", e.line, err))
+		}
+		versions[base] = append(versions[base], idx)
+	}
+
+	//dependents[i] lists the entries waiting on entry i, pending[i] how many entry i waits on
+	dependents := make([][]int, len(entries))
+	pending := make([]int, len(entries))
+
+	for idx, e := range entries {
+		for _, spec := range e.dependencies {
+			dependency, err := graph.ParseDependency(spec)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Line %d:%v", e.line, err))
+			}
+
+			for _, candidate := range versions[dependency.Name] {
+				_, version, _ := graph.ParsePackage(entries[candidate].name)
+				if candidate == idx || !dependency.Matches(version) {
+					continue
+				}
+				dependents[candidate] = append(dependents[candidate], idx)
+				pending[idx]++
+			}
+		}
+	}
+
+	sorted := make([]*entry, 0, len(entries))
+	done := make([]bool, len(entries))
+
+	for len(sorted) < len(entries) {
+		progressed := false
+
+		for idx, e := range entries {
+			if done[idx] || pending[idx] > 0 {
+				continue
+			}
+
+			done[idx] = true
+			progressed = true
+			sorted = append(sorted, e)
+			for _, dependent := range dependents[idx] {
+				pending[dependent]--
+			}
+			break
+		}
+
+		if !progressed {
+			var cycle []string
+			for idx, e := range entries {
+				if !done[idx] {
+					cycle = append(cycle, e.name)
+				}
+			}
+			return nil, errors.New(fmt.Sprintf("Packages depend on each other in a cycle:%s", strings.Join(cycle, ",")))
+		}
+	}
+
+	return sorted, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReadManifest(t *testing.T) {
+
+	var tests = []struct {
+		manifest    string
+		expected    string
+		expectedErr string
+	}{
+		{"", "", ""},
+		{"gmp\nisl gmp\n", "1:gmp[] 2:isl[gmp]", ""},
+		{"#name dependencies...\n\n  gmp  \ncloog\tgmp isl\n", "3:gmp[] 4:cloog[gmp isl]", ""},
+		{"app@1.0 libfoo>=1.2,<2 openssl@3\n", "1:app@1.0[libfoo>=1.2,<2 openssl@3]", ""},
+		{"gmp\n#gmp\n\ngmp isl\n", "", "Line 4:gmp is already listed on line 1"},
+	}
+
+	for _, test := range tests {
+		entries, err := readManifest(strings.NewReader(test.manifest))
+		if (err != nil || test.expectedErr != "") && fmt.Sprint(err) != test.expectedErr {
+			t.Errorf("readManifest(%q) error = %v, expected:%s", test.manifest, err, test.expectedErr)
+			continue
+		}
+
+		var read []string
+		for _, e := range entries {
+			read = append(read, fmt.Sprintf("%d:%s%v", e.line, e.name, e.dependencies))
+		}
+		if strings.Join(read, " ") != test.expected {
+			t.Errorf("readManifest(%q) = %s, expected:%s", test.manifest, strings.Join(read, " "), test.expected)
+		}
+	}
+}
+
+func TestSortManifest(t *testing.T) {
+
+	var tests = []struct {
+		manifest    string
+		expected    string
+		expectedErr string
+	}{
+		//Ordering, packages come after their dependencies and keep the manifest's order otherwise
+		{"gmp\nisl\nppl\n", "gmp,isl,ppl", ""},
+		{"cloog gmp isl\nisl gmp\ngmp\n", "gmp,isl,cloog", ""},
+		{"ppl gmp\ncloog isl\nisl\ngmp\n", "isl,cloog,gmp,ppl", ""},
+		//Dependencies the manifest doesn't list are left for the server
+		{"app openssl\ngmp\n", "app,gmp", ""},
+		//Version constraints only wait on the versions they match
+		{"app libfoo>=1.2,<2\nlibfoo@1.2\nlibfoo@2.0\n", "libfoo@1.2,app,libfoo@2.0", ""},
+		{"app libfoo>=1.2,<2\nlibfoo@2.0\nlibfoo@1.0\n", "app,libfoo@2.0,libfoo@1.0", ""},
+		{"app libfoo\nlibfoo@2.0\nlibfoo@1.2\n", "libfoo@2.0,libfoo@1.2,app", ""},
+		{"app openssl@3\nopenssl@1.1\nopenssl@3\n", "openssl@1.1,openssl@3,app", ""},
+		//Cycles
+		{"a b\nb a\n", "", "Packages depend on each other in a cycle:a,b"},
+		{"c\na b\nb c a\nd a\n", "", "Packages depend on each other in a cycle:a,b,d"},
+		{"a a\n", "a", ""},
+		//Malformed lines
+		{"gmp\napp@\n", "", "Line 2:Invalid version:app@"},
+		{"gmp\n\napp >=1.2\n", "", "Line 3:Invalid dependency:>=1.2"},
+		{"app libfoo>=1.2,~2\n", "", "Line 1:Invalid dependency:libfoo>=1.2,~2 Invalid constraint:~2"},
+	}
+
+	for _, test := range tests {
+		entries, err := readManifest(strings.NewReader(test.manifest))
+		if err != nil {
+			t.Fatalf("readManifest(%q) = %v, expected:nil", test.manifest, err)
+		}
+
+		sorted, err := sortManifest(entries)
+		if (err != nil || test.expectedErr != "") && fmt.Sprint(err) != test.expectedErr {
+			t.Errorf("sortManifest(%q) error = %v, expected:%s", test.manifest, err, test.expectedErr)
+			continue
+		}
+
+		var names []string
+		for _, e := range sorted {
+			names = append(names, e.name)
+		}
+		if strings.Join(names, ",") != test.expected {
+			t.Errorf("sortManifest(%q) = %s, expected:%s", test.manifest, strings.Join(names, ","), test.expected)
+		}
+	}
+}
+
+func TestWriteManifest(t *testing.T) {
+
+	manifest := "gmp\nisl gmp\napp@1.0 libfoo>=1.2,<2 openssl@3\n"
+
+	entries, err := readManifest(strings.NewReader(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var written bytes.Buffer
+	if err := writeManifest(&written, entries); err != nil || written.String() != manifest {
+		t.Errorf("writeManifest = %q %v, expected:%q", written.String(), err, manifest)
+	}
+}
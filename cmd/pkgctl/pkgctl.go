@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jrxfive/packagetree/pkg/client"
+	"github.com/jrxfive/packagetree/pkg/repomanager"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+//Exit codes, a command exits with the code of the response it got from the server
+const (
+	EXIT_OK          = 0
+	EXIT_FAIL        = 1
+	EXIT_ERROR       = 2
+	EXIT_UNAVAILABLE = 3
+)
+
+const DEFAULT_ADDRESS string = "localhost:8080"
+
+const usage = `Usage: pkgctl [flags] <command> [arguments]
+
+Commands:
+  index <package> [dependencies...]  index a package, e.g. index cloog gmp isl
+  remove <package>                   remove a package
+  query <package>                    check whether a package is indexed
+  push <manifest>                    index every package of a manifest in dependency order, - reads stdin
+  pull                               print every indexed package as a manifest
+
+A manifest lists one package per line followed by its dependencies separated by spaces,
+blank lines and lines starting with # are skipped.
+
+Exit codes: 0 OK, 1 FAIL, 2 ERROR or invalid usage, 3 server unavailable
+
+Flags:
+`
+
+func main() {
+
+	address := DEFAULT_ADDRESS
+	if envAddress, ok := os.LookupEnv("PACKAGE_ADDRESS"); ok {
+		address = envAddress
+	}
+
+	flags := flag.NewFlagSet("pkgctl", flag.ContinueOnError)
+	flags.StringVar(&address, "addr", address, "address of the package server, defaults to $PACKAGE_ADDRESS")
+	timeout := flags.Duration("timeout", client.DEFAULT_TIMEOUT, "how long a single request may take")
+	retries := flags.Int("retries", client.DEFAULT_RETRIES, "how many times requests failing on a lost connection are retried")
+	caFile := flags.String("cacert", "", "PEM bundle of CAs to verify the server with, connects with TLS")
+	certFile := flags.String("cert", "", "PEM client certificate for mutual TLS")
+	keyFile := flags.String("key", "", "PEM key of the client certificate")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+
+	if flags.Parse(os.Args[1:]) != nil || flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(EXIT_ERROR)
+	}
+
+	configuration := client.NewConfiguration(address)
+	configuration.PoolSize = 1
+	configuration.Timeout = *timeout
+	configuration.Retries = *retries
+
+	tlsConfig, err := newTLSConfig(*caFile, *certFile, *keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EXIT_ERROR)
+	}
+	configuration.TLSConfig = tlsConfig
+
+	c, err := client.NewClient(configuration)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EXIT_ERROR)
+	}
+
+	code := run(context.Background(), c, flags.Arg(0), flags.Args()[1:])
+	c.Close()
+
+	os.Exit(code)
+}
+
+//Runs command printing the server's response and returns the exit code for it
+func run(ctx context.Context, c *client.Client, command string, args []string) int {
+
+	switch {
+	case command == "index" && len(args) >= 1:
+		return report(c.Index(ctx, args[0], args[1:]...))
+	case command == "remove" && len(args) == 1:
+		return report(c.Remove(ctx, args[0]))
+	case command == "query" && len(args) == 1:
+		exists, err := c.Query(ctx, args[0])
+		if err == nil && !exists {
+			fmt.Println(repomanager.FAIL)
+			return EXIT_FAIL
+		}
+		return report(err)
+	case command == "push" && len(args) == 1:
+		return push(ctx, c, args[0])
+	case command == "pull" && len(args) == 0:
+		return pull(ctx, c, os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid command:%s, see pkgctl -h\n", strings.TrimSpace(command+" "+strings.Join(args, " ")))
+		return EXIT_ERROR
+	}
+}
+
+//Prints the response a request got in the server's format, e.g. FAIL|MISSING_DEPENDENCIES|gmp,
+//and returns its exit code. Errors reaching the server are printed to stderr.
+func report(err error) int {
+
+	if e, ok := err.(*client.FailError); ok {
+		fmt.Println(strings.Join([]string{repomanager.FAIL, e.Reason, strings.Join(e.Packages, ",")}, "|"))
+		return EXIT_FAIL
+	}
+
+	switch err {
+	case nil:
+		fmt.Println(repomanager.OK)
+		return EXIT_OK
+	case client.ErrNotIndexed:
+		fmt.Println(repomanager.FAIL)
+		return EXIT_FAIL
+	case client.ErrRequest, client.ErrListUnsupported:
+		fmt.Println(repomanager.ERROR)
+		return EXIT_ERROR
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_UNAVAILABLE
+	}
+}
+
+//Indexes every package of the manifest at path in dependency order, stopping at the first
+//one that isn't indexed
+func push(ctx context.Context, c *client.Client, path string) int {
+
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_ERROR
+		}
+		defer f.Close()
+		r = f
+	}
+
+	entries, err := readManifest(r)
+	if err == nil {
+		entries, err = sortManifest(entries)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid manifest %s:%v\n", path, err)
+		return EXIT_ERROR
+	}
+
+	for _, e := range entries {
+		err = c.Index(ctx, e.name, e.dependencies...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to index %s from line %d\n", e.name, e.line)
+			return report(err)
+		}
+	}
+
+	fmt.Println(repomanager.OK)
+	return EXIT_OK
+}
+
+//Prints every indexed package with its dependencies as a manifest push can read back. The
+//packages are listed first and their dependencies looked up one by one, changes made in
+//between may be missed.
+func pull(ctx context.Context, c *client.Client, w io.Writer) int {
+
+	packages, err := c.List(ctx)
+	if err != nil {
+		return report(err)
+	}
+
+	entries := make([]*entry, 0, len(packages))
+	for _, name := range packages {
+		dependencies, err := c.Dependencies(ctx, name)
+		if err == client.ErrNotIndexed {
+			continue
+		}
+		if err != nil {
+			return report(err)
+		}
+
+		entries = append(entries, &entry{name: name, dependencies: dependencies})
+	}
+
+	err = writeManifest(w, entries)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_ERROR
+	}
+
+	return EXIT_OK
+}
+
+//Connects with TLS when a CA bundle or a client certificate is given, nil otherwise
+func newTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("No certificates found in:%s", caFile))
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
@@ -1,17 +1,43 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/jrxfive/packagetree/pkg/graph"
 	"github.com/jrxfive/packagetree/pkg/logging"
+	"github.com/jrxfive/packagetree/pkg/metrics"
+	"github.com/jrxfive/packagetree/pkg/replication"
 	"github.com/jrxfive/packagetree/pkg/repomanager"
 	"github.com/jrxfive/packagetree/pkg/server"
+	"github.com/jrxfive/packagetree/pkg/storage"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var PORT int = 8080
 var MAX_HERD int = 10
+var HERD_POLICY string = server.HERD_POLICY_QUEUE
+var HERD_WAIT_TIMEOUT int = 5
 var CONNECTION_TIMEOUT = 10
+var LOCK_TIMEOUT = 5
+var DRAIN_TIMEOUT = 10
+var MAX_SESSION_LIFETIME = 0
+var TLS_CERT string = ""
+var TLS_KEY string = ""
+var TLS_CLIENT_CA string = ""
+var DATA_DIR string = ""
+var COMPACT_SIZE int = storage.DEFAULT_COMPACT_SIZE
+var HTTP_PORT int = 0
+var REPLICATION_PORT int = 0
+var JSON_PORT int = 0
+var LEADER string = ""
+var LEADER_ADDRESS string = ""
+var METRICS_PORT int = 0
 var logger = logging.GetLogger()
 
 func init() {
@@ -33,6 +59,19 @@ func init() {
 		}
 	}
 
+	if envHerdPolicy, ok := os.LookupEnv("PACKAGE_HERD_POLICY"); ok {
+		HERD_POLICY = envHerdPolicy
+	}
+
+	if envHerdWaitTimeout, ok := os.LookupEnv("PACKAGE_HERD_WAIT_TIMEOUT"); ok {
+		value, err := strconv.Atoi(envHerdWaitTimeout)
+		if err != nil {
+
+		} else {
+			HERD_WAIT_TIMEOUT = value
+		}
+	}
+
 	if envConnTimeout, ok := os.LookupEnv("PACKAGE_CONNECTION_TIMEOUT"); ok {
 		value, err := strconv.Atoi(envConnTimeout)
 		if err != nil {
@@ -42,21 +81,311 @@ func init() {
 		}
 	}
 
+	if envLockTimeout, ok := os.LookupEnv("PACKAGE_LOCK_TIMEOUT"); ok {
+		value, err := strconv.Atoi(envLockTimeout)
+		if err != nil {
+
+		} else {
+			LOCK_TIMEOUT = value
+		}
+	}
+
+	if envDrainTimeout, ok := os.LookupEnv("PACKAGE_DRAIN_TIMEOUT"); ok {
+		value, err := strconv.Atoi(envDrainTimeout)
+		if err != nil {
+
+		} else {
+			DRAIN_TIMEOUT = value
+		}
+	}
+
+	if envMaxLifetime, ok := os.LookupEnv("PACKAGE_MAX_SESSION_LIFETIME"); ok {
+		value, err := strconv.Atoi(envMaxLifetime)
+		if err != nil {
+
+		} else {
+			MAX_SESSION_LIFETIME = value
+		}
+	}
+
+	if envTLSCert, ok := os.LookupEnv("PACKAGE_TLS_CERT"); ok {
+		TLS_CERT = envTLSCert
+	}
+
+	if envTLSKey, ok := os.LookupEnv("PACKAGE_TLS_KEY"); ok {
+		TLS_KEY = envTLSKey
+	}
+
+	if envTLSClientCA, ok := os.LookupEnv("PACKAGE_TLS_CLIENT_CA"); ok {
+		TLS_CLIENT_CA = envTLSClientCA
+	}
+
+	if envDataDir, ok := os.LookupEnv("PACKAGE_DATA_DIR"); ok {
+		DATA_DIR = envDataDir
+	}
+
+	if envCompactSize, ok := os.LookupEnv("PACKAGE_COMPACT_SIZE"); ok {
+		value, err := strconv.Atoi(envCompactSize)
+		if err != nil {
+
+		} else {
+			COMPACT_SIZE = value
+		}
+	}
+
+	if envReplicationPort, ok := os.LookupEnv("PACKAGE_REPLICATION_PORT"); ok {
+		value, err := strconv.Atoi(envReplicationPort)
+		if err != nil {
+
+		} else {
+			REPLICATION_PORT = value
+		}
+	}
+
+	if envJSONPort, ok := os.LookupEnv("PACKAGE_JSON_PORT"); ok {
+		value, err := strconv.Atoi(envJSONPort)
+		if err != nil {
+
+		} else {
+			JSON_PORT = value
+		}
+	}
+
+	if envLeader, ok := os.LookupEnv("PACKAGE_LEADER"); ok {
+		LEADER = envLeader
+	}
+
+	if envLeaderAddress, ok := os.LookupEnv("PACKAGE_LEADER_ADDRESS"); ok {
+		LEADER_ADDRESS = envLeaderAddress
+	}
+
+	if envHTTPPort, ok := os.LookupEnv("PACKAGE_HTTP_PORT"); ok {
+		value, err := strconv.Atoi(envHTTPPort)
+		if err != nil {
+
+		} else {
+			HTTP_PORT = value
+		}
+	}
+
+	if envMetricsPort, ok := os.LookupEnv("PACKAGE_METRICS_PORT"); ok {
+		value, err := strconv.Atoi(envMetricsPort)
+		if err != nil {
+
+		} else {
+			METRICS_PORT = value
+		}
+	}
+
 	logger.Printf("Starting new server on port:%v\n", PORT)
 	logger.Printf("MAX_HERD set to:%v\n", MAX_HERD)
+	logger.Printf("Herd policy set to:%v wait timeout:%v\n", HERD_POLICY, HERD_WAIT_TIMEOUT)
 	logger.Printf("Connection timeout set to:%v\n", CONNECTION_TIMEOUT)
+	logger.Printf("Lock timeout set to:%v\n", LOCK_TIMEOUT)
+	logger.Printf("Drain timeout set to:%v\n", DRAIN_TIMEOUT)
+	logger.Printf("Max session lifetime set to:%v\n", MAX_SESSION_LIFETIME)
+	if TLS_CERT != "" {
+		logger.Printf("Serving TLS with certificate:%v client CA:%v\n", TLS_CERT, TLS_CLIENT_CA)
+	}
+	if DATA_DIR != "" {
+		logger.Printf("Persisting packages to:%v compacting every:%v changes\n", DATA_DIR, COMPACT_SIZE)
+	}
+	if JSON_PORT != 0 {
+		logger.Printf("Serving JSON lines protocol on port:%v\n", JSON_PORT)
+	}
+	if LEADER != "" {
+		logger.Printf("Replicating read only from leader:%v serving clients on:%v\n", LEADER, LEADER_ADDRESS)
+	}
+	if REPLICATION_PORT != 0 {
+		logger.Printf("Serving followers on port:%v\n", REPLICATION_PORT)
+	}
+	if HTTP_PORT != 0 {
+		logger.Printf("Starting HTTP admin API on port:%v\n", HTTP_PORT)
+	}
+	if METRICS_PORT != 0 {
+		logger.Printf("Serving metrics on port:%v\n", METRICS_PORT)
+	}
+}
+
+//Creates the in-memory graph, or a disk backed graph recovered from DATA_DIR when set. With
+//LEADER set a read only replica following the leader until ctx is done is returned instead.
+func newBackend(ctx context.Context) (repomanager.Backend, func() error, error) {
+	if LEADER != "" {
+		f, err := replication.NewFollower(LEADER)
+		if err != nil {
+			return nil, nil, err
+		}
+		f.SetLeaderAddress(LEADER_ADDRESS)
+
+		go f.Run(ctx)
+		return f, func() error { return nil }, nil
+	}
+
+	if DATA_DIR == "" {
+		g, err := graph.NewGraph()
+		return g, func() error { return nil }, err
+	}
+
+	b, err := storage.NewDiskBackend(DATA_DIR, COMPACT_SIZE)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return b, b.Close, nil
+}
+
+//Wraps backend in a replication leader and serves its followers on port until ctx is done
+func serveReplication(ctx context.Context, port int, backend repomanager.Backend) (repomanager.Backend, error) {
+
+	replicated, ok := backend.(replication.Backend)
+	if !ok {
+		return nil, fmt.Errorf("Backend %T can't be replicated", backend)
+	}
+
+	leader := replication.NewLeader(replicated)
+
+	configuration := server.NewServerConfiguration(leader, port, MAX_HERD)
+	configuration.HerdPolicy = server.HERD_POLICY_REJECT
+	configuration.DrainNotice = ""
+
+	replicationServer, err := server.NewServer(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		err := replicationServer.Serve(ctx)
+		if err != nil {
+			logger.Println(err)
+		}
+	}()
+
+	return leader, nil
+}
+
+//Creates the TCP server configuration shared by every protocol listener
+func newServerConfiguration(handler server.ConnectionHandler, port int) *server.Configuration {
+	configuration := server.NewServerConfiguration(handler, port, MAX_HERD)
+	configuration.HerdPolicy = HERD_POLICY
+	configuration.HerdWaitTimeout = time.Duration(HERD_WAIT_TIMEOUT) * time.Second
+	configuration.CertFile = TLS_CERT
+	configuration.KeyFile = TLS_KEY
+	configuration.ClientCAFile = TLS_CLIENT_CA
+	configuration.MaxLifetime = time.Duration(MAX_SESSION_LIFETIME) * time.Second
+	configuration.DrainTimeout = time.Duration(DRAIN_TIMEOUT) * time.Second
+
+	return configuration
+}
+
+//Starts serving handler on port in the background
+func serveHTTP(port int, handler http.Handler) *http.Server {
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%v", port),
+		Handler: handler,
+	}
+
+	go func() {
+		err := httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			logger.Println(err)
+		}
+	}()
+
+	return httpServer
+}
+
+//Reports the package and edge counts of the repo whenever metrics are scraped
+func registerSizeMetrics(repo *repomanager.Repo) {
+	metrics.NewGaugeFunc("packagetree_packages", "Packages currently indexed.", func() float64 {
+		packages, _, _ := repo.Size()
+		return float64(packages)
+	})
+
+	metrics.NewGaugeFunc("packagetree_dependency_edges", "Dependency edges between indexed packages.", func() float64 {
+		_, edges, _ := repo.Size()
+		return float64(edges)
+	})
 }
 
 func main() {
-	g, err := graph.NewGraph()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	backend, closeBackend, err := newBackend(ctx)
 	if err != nil {
+		logger.Println(err)
 		os.Exit(1)
 	}
 
-	repo := repomanager.NewRepo(g)
-	serverConfiguration := server.NewServerConfiguration(repo, PORT, MAX_HERD, CONNECTION_TIMEOUT)
+	if REPLICATION_PORT != 0 {
+		backend, err = serveReplication(ctx, REPLICATION_PORT, backend)
+		if err != nil {
+			logger.Println(err)
+			closeBackend()
+			os.Exit(1)
+		}
+	}
 
-	err = server.Listen(serverConfiguration)
+	repo := repomanager.NewRepo(backend)
+	repo.SetIdleTimeout(time.Duration(CONNECTION_TIMEOUT) * time.Second)
+	repo.SetLockTimeout(time.Duration(LOCK_TIMEOUT) * time.Second)
+	logger.Printf("Serving commands:%s\n", strings.Join(repomanager.Commands(), ","))
+
+	var httpServers []*http.Server
+	if HTTP_PORT != 0 {
+		httpServers = append(httpServers, serveHTTP(HTTP_PORT, repomanager.NewHTTPHandler(repo)))
+	}
+
+	if METRICS_PORT != 0 {
+		registerSizeMetrics(repo)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.DefaultRegistry)
+		httpServers = append(httpServers, serveHTTP(METRICS_PORT, mux))
+	}
+
+	packageServer, err := server.NewServer(newServerConfiguration(repo, PORT))
+	if err != nil {
+		logger.Println(err)
+		cancel()
+		closeBackend()
+		os.Exit(1)
+	}
+
+	jsonServed := make(chan struct{})
+	if JSON_PORT != 0 {
+		jsonServer, err := server.NewServer(newServerConfiguration(repomanager.NewCodecHandler(repo, repomanager.JSONCodec{}), JSON_PORT))
+		if err != nil {
+			logger.Println(err)
+			cancel()
+			closeBackend()
+			os.Exit(1)
+		}
+
+		go func() {
+			err := jsonServer.Serve(ctx)
+			if err != nil {
+				logger.Println(err)
+			}
+			close(jsonServed)
+		}()
+	} else {
+		close(jsonServed)
+	}
+
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-signalChannel
+		logger.Printf("Signal:%v received closing listener and draining connections\n", s)
+		cancel()
+	}()
+
+	err = packageServer.Serve(ctx)
+	cancel()
+	<-jsonServed
+	for _, httpServer := range httpServers {
+		httpServer.Shutdown(context.Background())
+	}
+	closeBackend()
 	if err != nil {
 		os.Exit(1)
 	}
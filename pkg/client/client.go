@@ -0,0 +1,320 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/jrxfive/packagetree/pkg/graph"
+	"github.com/jrxfive/packagetree/pkg/repomanager"
+	"github.com/jrxfive/packagetree/pkg/server"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_POOL_SIZE     int           = 4
+	DEFAULT_DIAL_TIMEOUT  time.Duration = 5 * time.Second
+	DEFAULT_TIMEOUT       time.Duration = 10 * time.Second
+	DEFAULT_IDLE_TIMEOUT  time.Duration = 5 * time.Second
+	DEFAULT_RETRIES       int           = 2
+	DEFAULT_RETRY_BACKOFF time.Duration = 100 * time.Millisecond
+)
+
+//Returned once Close has been called
+var ErrClosed = errors.New("Client is closed")
+
+//Returned when the server answers ERROR, the request was malformed or the server couldn't
+//get to it in time
+var ErrRequest = errors.New("Request was answered with ERROR")
+
+//Returned by Dependencies, Dependents and Order for packages that aren't indexed
+var ErrNotIndexed = errors.New("Package is not indexed")
+
+//Returned by List when the server's backend can't list its packages
+var ErrListUnsupported = errors.New("Server can't list its packages")
+
+//Returned by Index and Remove when the server answers FAIL. Reason is one of the verbose
+//reason codes, e.g. repomanager.MISSING_DEPENDENCIES, and Packages the packages involved.
+type FailError struct {
+	Command  string
+	Name     string
+	Reason   string
+	Packages []string
+}
+
+func (e *FailError) Error() string {
+	return fmt.Sprintf("%s %s failed:%s %s", e.Command, e.Name, e.Reason, strings.Join(e.Packages, ","))
+}
+
+type Configuration struct {
+	Address      string
+	PoolSize     int
+	DialTimeout  time.Duration
+	Timeout      time.Duration
+	IdleTimeout  time.Duration
+	Retries      int
+	RetryBackoff time.Duration
+	TLSConfig    *tls.Config
+}
+
+//Creates and returns a new configuration for the package server on address. At most
+//DEFAULT_POOL_SIZE connections are opened, requests made while every one of them is busy wait
+//for one to be free. Requests taking longer than DEFAULT_TIMEOUT fail unless the context
+//given sets an earlier deadline. Connections left unused for DEFAULT_IDLE_TIMEOUT are closed
+//rather than reused, it must stay below the server's PACKAGE_CONNECTION_TIMEOUT. Requests
+//failing because the connection was lost or the server was busy or shutting down are retried
+//DEFAULT_RETRIES times on a new connection, waiting DEFAULT_RETRY_BACKOFF longer each time.
+//Setting TLSConfig connects with TLS.
+func NewConfiguration(address string) *Configuration {
+	return &Configuration{
+		Address:      address,
+		PoolSize:     DEFAULT_POOL_SIZE,
+		DialTimeout:  DEFAULT_DIAL_TIMEOUT,
+		Timeout:      DEFAULT_TIMEOUT,
+		IdleTimeout:  DEFAULT_IDLE_TIMEOUT,
+		Retries:      DEFAULT_RETRIES,
+		RetryBackoff: DEFAULT_RETRY_BACKOFF,
+	}
+}
+
+//Client of the package server's TCP protocol, safe to use from several goroutines. Every
+//pooled connection has verbose responses turned on so failures come back as a *FailError
+//carrying the reason.
+type Client struct {
+	configuration *Configuration
+	pool          *pool
+}
+
+func NewClient(configuration *Configuration) (*Client, error) {
+
+	if configuration.Address == "" {
+		return nil, errors.New("Client requires an address")
+	}
+	if configuration.PoolSize < 1 {
+		return nil, errors.New(fmt.Sprintf("Invalid pool size:%d", configuration.PoolSize))
+	}
+
+	return &Client{
+		configuration: configuration,
+		pool:          newPool(configuration),
+	}, nil
+}
+
+//Closes every idle connection, requests in flight finish and close theirs
+func (c *Client) Close() error {
+	c.pool.close()
+	return nil
+}
+
+//Indexes name with its dependencies, a dependency may carry version constraints such as
+//libfoo>=1.2,<2
+func (c *Client) Index(ctx context.Context, name string, dependencies ...string) error {
+	return c.change(ctx, repomanager.INDEX, name, dependencies)
+}
+
+//Removes name, removing a package that isn't indexed succeeds
+func (c *Client) Remove(ctx context.Context, name string) error {
+	return c.change(ctx, repomanager.REMOVE, name, nil)
+}
+
+//Reports whether name is indexed, a bare name such as openssl is indexed when any version of
+//it is
+func (c *Client) Query(ctx context.Context, name string) (bool, error) {
+
+	output, err := c.do(ctx, repomanager.QUERY, name, nil)
+	if err != nil {
+		return false, err
+	}
+
+	switch status(output) {
+	case repomanager.OK:
+		return true, nil
+	case repomanager.FAIL:
+		return false, nil
+	default:
+		return false, ErrRequest
+	}
+}
+
+//Returns the dependencies name was indexed with
+func (c *Client) Dependencies(ctx context.Context, name string) ([]string, error) {
+	return c.lookup(ctx, repomanager.DEPS, name, nil)
+}
+
+//Returns the packages depending on name, or every package depending on it directly or
+//indirectly when transitive is set
+func (c *Client) Dependents(ctx context.Context, name string, transitive bool) ([]string, error) {
+
+	var options []string
+	if transitive {
+		options = []string{repomanager.TRANSITIVE}
+	}
+
+	return c.lookup(ctx, repomanager.RDEPS, name, options)
+}
+
+//Returns name and its transitive dependencies in install order
+func (c *Client) Order(ctx context.Context, name string) ([]string, error) {
+	return c.lookup(ctx, repomanager.ORDER, name, nil)
+}
+
+//Returns every indexed package in an order they can be installed in
+func (c *Client) List(ctx context.Context) ([]string, error) {
+
+	packages, err := c.lookup(ctx, repomanager.LIST, "", nil)
+	if err == ErrNotIndexed {
+		return nil, ErrListUnsupported
+	}
+
+	return packages, err
+}
+
+func (c *Client) change(ctx context.Context, command, name string, dependencies []string) error {
+
+	output, err := c.do(ctx, command, name, dependencies)
+	if err != nil {
+		return err
+	}
+
+	fields := strings.SplitN(output, "|", 3)
+	switch fields[0] {
+	case repomanager.OK:
+		return nil
+	case repomanager.FAIL:
+		e := &FailError{Command: command, Name: name}
+		if len(fields) == 3 {
+			e.Reason = fields[1]
+			e.Packages = splitPackages(fields[2])
+		}
+		return e
+	default:
+		return ErrRequest
+	}
+}
+
+//Runs a command answered with OK|packages
+func (c *Client) lookup(ctx context.Context, command, name string, options []string) ([]string, error) {
+
+	output, err := c.do(ctx, command, name, options)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.SplitN(output, "|", 2)
+	switch fields[0] {
+	case repomanager.OK:
+		if len(fields) == 2 {
+			return splitPackages(fields[1]), nil
+		}
+		return []string{}, nil
+	case repomanager.FAIL:
+		return nil, ErrNotIndexed
+	default:
+		return nil, ErrRequest
+	}
+}
+
+//Sends command|name|dependencies and returns the response, retrying it on a new connection
+//when the one used was lost or the server turned it away
+func (c *Client) do(ctx context.Context, command, name string, dependencies []string) (string, error) {
+
+	if strings.ContainsAny(name, "|\n") || strings.ContainsAny(strings.Join(dependencies, ""), "|\n") {
+		return "", ErrRequest
+	}
+	message := command + "|" + name + "|" + strings.Join(dependencies, ",")
+
+	for attempt := 0; ; attempt++ {
+		output, err := c.roundTrip(ctx, message)
+		if err == nil || !retryable(err) || attempt >= c.configuration.Retries {
+			return output, err
+		}
+
+		select {
+		case <-time.After(time.Duration(attempt+1) * c.configuration.RetryBackoff):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+//Sends a single message on a pooled connection. Connections are only put back once they have
+//been answered, any failure closes them.
+func (c *Client) roundTrip(ctx context.Context, message string) (string, error) {
+
+	conn, err := c.pool.get(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(c.configuration.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	output, err := conn.send(message, deadline)
+	if err == nil && isNotice(output) {
+		err = &noticeError{notice: output}
+	}
+	if err != nil {
+		c.pool.put(conn, false)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	}
+
+	c.pool.put(conn, true)
+	return output, nil
+}
+
+//Sent by the server in place of a response when it closes the connection without running the
+//message, the message is safe to send again
+type noticeError struct {
+	notice string
+}
+
+func (e *noticeError) Error() string {
+	return fmt.Sprintf("Server closed the connection:%s", e.notice)
+}
+
+func isNotice(output string) bool {
+	return output == server.DEFAULT_BUSY_NOTICE || output == server.DEFAULT_DRAIN_NOTICE || output == server.DEFAULT_LIFETIME_NOTICE
+}
+
+//Lost connections and notices are retried, INDEX and REMOVE can be sent twice without harm
+func retryable(err error) bool {
+
+	switch err.(type) {
+	case *noticeError, net.Error:
+		return true
+	}
+
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+func status(output string) string {
+	return strings.SplitN(output, "|", 2)[0]
+}
+
+//Splits comma delimited packages, an item starting with a constraint operator such as <2 in
+//libfoo>=1.2,<2 continues the package before it
+func splitPackages(packages string) []string {
+
+	split := []string{}
+	if packages == "" {
+		return split
+	}
+
+	for _, item := range strings.Split(packages, ",") {
+		if len(split) > 0 && item != "" && strings.ContainsRune(graph.CONSTRAINT_CHARS, rune(item[0])) {
+			split[len(split)-1] += "," + item
+			continue
+		}
+		split = append(split, item)
+	}
+
+	return split
+}
@@ -0,0 +1,291 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/jrxfive/packagetree/pkg/graph"
+	"github.com/jrxfive/packagetree/pkg/repomanager"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Serves repo on a local port counting the connections accepted, the first busy connections
+//are sent BUSY and closed the way a server at MaxHerd does
+func serve(repo *repomanager.Repo, busy int, t *testing.T) (string, func() int, func()) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	accepted := 0
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			accepted++
+			turnAway := accepted <= busy
+			mu.Unlock()
+
+			if turnAway {
+				fmt.Fprintln(conn, "BUSY")
+				conn.Close()
+				continue
+			}
+			go repo.Handle(conn)
+		}
+	}()
+
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return accepted
+	}
+
+	return listener.Addr().String(), count, func() { listener.Close() }
+}
+
+func newRepo() *repomanager.Repo {
+	g, _ := graph.NewGraph()
+	return repomanager.NewRepo(g)
+}
+
+func TestClient(t *testing.T) {
+
+	addr, _, closeListener := serve(newRepo(), 0, t)
+	defer closeListener()
+
+	c, err := NewClient(NewConfiguration(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+
+	var changes = []struct {
+		remove       bool
+		name         string
+		dependencies []string
+		expectedErr  error
+	}{
+		{false, "gmp", nil, nil},
+		{false, "isl", []string{"gmp"}, nil},
+		{false, "libfoo@1.2", nil, nil},
+		{false, "cloog", []string{"gmp", "isl"}, nil},
+		{false, "app", []string{"libfoo>=1.2,<2"}, nil},
+		{false, "ppl", []string{"gmp", "libfoo>=3"}, &FailError{Command: "INDEX", Name: "ppl", Reason: "MISSING_DEPENDENCIES", Packages: []string{"libfoo>=3"}}},
+		{false, "emacs=elisp", nil, ErrRequest},
+		{false, "emacs|elisp", nil, ErrRequest},
+		{true, "gmp", nil, &FailError{Command: "REMOVE", Name: "gmp", Reason: "HAS_DEPENDENTS", Packages: []string{"cloog", "isl"}}},
+		{true, "unknown", nil, nil},
+	}
+
+	for _, change := range changes {
+		if change.remove {
+			err = c.Remove(ctx, change.name)
+		} else {
+			err = c.Index(ctx, change.name, change.dependencies...)
+		}
+
+		if fmt.Sprintf("%#v", err) != fmt.Sprintf("%#v", change.expectedErr) {
+			t.Errorf("Change %s%v remove:%v = %#v, expected:%#v", change.name, change.dependencies, change.remove, err, change.expectedErr)
+		}
+	}
+
+	var queries = []struct {
+		name     string
+		expected bool
+	}{
+		{"gmp", true},
+		{"libfoo", true},
+		{"ppl", false},
+	}
+
+	for _, query := range queries {
+		if exists, err := c.Query(ctx, query.name); err != nil || exists != query.expected {
+			t.Errorf("Query(%s) = %v %v, expected:%v", query.name, exists, err, query.expected)
+		}
+	}
+
+	var lookups = []struct {
+		lookup      func(ctx context.Context, name string) ([]string, error)
+		name        string
+		expected    string
+		expectedErr error
+	}{
+		{c.Dependencies, "cloog", "gmp,isl", nil},
+		{c.Dependencies, "gmp", "", nil},
+		{c.Dependencies, "ppl", "", ErrNotIndexed},
+		{c.Order, "cloog", "gmp,isl,cloog", nil},
+		{func(ctx context.Context, name string) ([]string, error) { return c.Dependents(ctx, name, true) }, "gmp", "cloog,isl", nil},
+		{func(ctx context.Context, name string) ([]string, error) { return c.Dependents(ctx, name, false) }, "isl", "cloog", nil},
+	}
+
+	for _, lookup := range lookups {
+		packages, err := lookup.lookup(ctx, lookup.name)
+		if err != lookup.expectedErr || strings.Join(packages, ",") != lookup.expected {
+			t.Errorf("Lookup(%s) = %v %v, expected:%s %v", lookup.name, packages, err, lookup.expected, lookup.expectedErr)
+		}
+	}
+
+	if packages, err := c.List(ctx); err != nil || strings.Join(packages, ",") != "libfoo@1.2,app,gmp,isl,cloog" {
+		t.Errorf("List() = %v %v, expected:[libfoo@1.2 app gmp isl cloog]", packages, err)
+	}
+
+	c.Close()
+	if _, err := c.Query(ctx, "gmp"); err != ErrClosed {
+		t.Errorf("Query after Close = %v, expected:%v", err, ErrClosed)
+	}
+}
+
+func TestClientPool(t *testing.T) {
+
+	addr, accepted, closeListener := serve(newRepo(), 0, t)
+	defer closeListener()
+
+	configuration := NewConfiguration(addr)
+	configuration.PoolSize = 2
+
+	c, err := NewClient(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for idx := 0; idx < 50; idx++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+
+			name := fmt.Sprintf("package-%d", idx)
+			if err := c.Index(context.Background(), name); err != nil {
+				t.Errorf("Index(%s) = %v, expected:nil", name, err)
+			}
+			if exists, err := c.Query(context.Background(), name); !exists || err != nil {
+				t.Errorf("Query(%s) = %v %v, expected:true", name, exists, err)
+			}
+		}(idx)
+	}
+	wg.Wait()
+
+	if accepted() > configuration.PoolSize {
+		t.Errorf("Client opened %d connections, expected at most:%d", accepted(), configuration.PoolSize)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+
+	repo := newRepo()
+	repo.SetIdleTimeout(100 * time.Millisecond)
+
+	addr, accepted, closeListener := serve(repo, 0, t)
+	defer closeListener()
+
+	var tests = []struct {
+		idleTimeout time.Duration
+		retries     int
+		expectedErr bool
+	}{
+		//Stale connections are dropped before the server closes them
+		{50 * time.Millisecond, 0, false},
+		//Stale connections the server closed are retried on a new one
+		{0, 1, false},
+		{0, 0, true},
+	}
+
+	for _, test := range tests {
+		configuration := NewConfiguration(addr)
+		configuration.IdleTimeout = test.idleTimeout
+		configuration.Retries = test.retries
+
+		c, err := NewClient(configuration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.Query(context.Background(), "gmp"); err != nil {
+			t.Fatalf("Query = %v, expected:nil", err)
+		}
+		before := accepted()
+
+		time.Sleep(300 * time.Millisecond)
+
+		_, err = c.Query(context.Background(), "gmp")
+		if (err != nil) != test.expectedErr {
+			t.Errorf("Idle timeout:%v retries:%d Query after the server's idle timeout = %v, expected error:%v", test.idleTimeout, test.retries, err, test.expectedErr)
+		}
+		if !test.expectedErr && accepted() != before+1 {
+			t.Errorf("Idle timeout:%v retries:%d accepted:%d connections, expected:%d", test.idleTimeout, test.retries, accepted(), before+1)
+		}
+
+		c.Close()
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+
+	var tests = []struct {
+		busy        int
+		retries     int
+		expectedErr bool
+	}{
+		{0, 0, false},
+		{1, 0, true},
+		{2, 2, false},
+		{3, 2, true},
+	}
+
+	for _, test := range tests {
+		addr, _, closeListener := serve(newRepo(), test.busy, t)
+
+		configuration := NewConfiguration(addr)
+		configuration.Retries = test.retries
+		configuration.RetryBackoff = 10 * time.Millisecond
+
+		c, err := NewClient(configuration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Index(context.Background(), "gmp")
+		if (err != nil) != test.expectedErr {
+			t.Errorf("Busy:%d retries:%d Index = %v, expected error:%v", test.busy, test.retries, err, test.expectedErr)
+		}
+		if _, ok := err.(*noticeError); test.expectedErr && !ok {
+			t.Errorf("Busy:%d retries:%d Index = %#v, expected:*noticeError", test.busy, test.retries, err)
+		}
+
+		c.Close()
+		closeListener()
+	}
+}
+
+func TestSplitPackages(t *testing.T) {
+
+	var tests = []struct {
+		packages string
+		expected []string
+	}{
+		{"", []string{}},
+		{"gmp", []string{"gmp"}},
+		{"gmp,isl", []string{"gmp", "isl"}},
+		{"libfoo>=1.2,<2,gmp", []string{"libfoo>=1.2,<2", "gmp"}},
+	}
+
+	for _, test := range tests {
+		if packages := splitPackages(test.packages); fmt.Sprint(packages) != fmt.Sprint(test.expected) || len(packages) != len(test.expected) {
+			t.Errorf("splitPackages(%s) = %q, expected:%q", test.packages, packages, test.expected)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/jrxfive/packagetree/pkg/repomanager"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Connections to a single server. slots bounds how many are open at once, idle holds the
+//ones waiting to be reused.
+type pool struct {
+	configuration *Configuration
+	slots         chan struct{}
+	idle          chan *conn
+	mu            sync.Mutex
+	closed        bool
+}
+
+//Connection with verbose responses turned on, used is when it was last answered
+type conn struct {
+	net.Conn
+	reader *bufio.Reader
+	used   time.Time
+}
+
+func newPool(configuration *Configuration) *pool {
+	return &pool{
+		configuration: configuration,
+		slots:         make(chan struct{}, configuration.PoolSize),
+		idle:          make(chan *conn, configuration.PoolSize),
+	}
+}
+
+//Returns an idle connection or dials a new one, waiting for a slot while PoolSize
+//connections are in use. Idle connections unused for longer than IdleTimeout are closed,
+//the server is about to or already did.
+func (p *pool) get(ctx context.Context) (*conn, error) {
+
+	if p.isClosed() {
+		return nil, ErrClosed
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for {
+		select {
+		case c := <-p.idle:
+			if p.configuration.IdleTimeout > 0 && time.Since(c.used) >= p.configuration.IdleTimeout {
+				c.Close()
+				continue
+			}
+			return c, nil
+		default:
+		}
+
+		c, err := p.dial(ctx)
+		if err != nil {
+			<-p.slots
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+//Gives back a connection taken with get, connections that failed are closed
+func (p *pool) put(c *conn, healthy bool) {
+
+	defer func() { <-p.slots }()
+
+	if !healthy || p.isClosed() {
+		c.Close()
+		return
+	}
+
+	c.used = time.Now()
+	p.idle <- c
+}
+
+func (p *pool) close() {
+
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	for {
+		select {
+		case c := <-p.idle:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (p *pool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.closed
+}
+
+func (p *pool) dial(ctx context.Context) (*conn, error) {
+
+	netConn, err := (&net.Dialer{Timeout: p.configuration.DialTimeout}).DialContext(ctx, "tcp", p.configuration.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(p.configuration.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	if p.configuration.TLSConfig != nil {
+		tlsConn := tls.Client(netConn, p.tlsConfig())
+		tlsConn.SetDeadline(deadline)
+		err = tlsConn.Handshake()
+		if err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		netConn = tlsConn
+	}
+
+	c := &conn{
+		Conn:   netConn,
+		reader: bufio.NewReader(netConn),
+	}
+
+	output, err := c.send(repomanager.VERBOSE+"|"+repomanager.VERBOSE_ON+"|", deadline)
+	if err == nil && output != repomanager.OK {
+		if isNotice(output) {
+			err = &noticeError{notice: output}
+		} else {
+			err = errors.New(fmt.Sprintf("Server answered %s to VERBOSE", output))
+		}
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+//Defaults ServerName to the host dialed
+func (p *pool) tlsConfig() *tls.Config {
+
+	config := p.configuration.TLSConfig
+	if config.ServerName != "" {
+		return config
+	}
+
+	host, _, err := net.SplitHostPort(p.configuration.Address)
+	if err != nil {
+		return config
+	}
+
+	config = config.Clone()
+	config.ServerName = host
+	return config
+}
+
+//Writes message and reads the single line answering it
+func (c *conn) send(message string, deadline time.Time) (string, error) {
+
+	c.SetDeadline(deadline)
+
+	_, err := c.Write([]byte(message + "\n"))
+	if err != nil {
+		return "", err
+	}
+
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(line, "\n"), nil
+}
@@ -3,6 +3,8 @@ package graph
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 )
 
 const (
@@ -10,19 +12,55 @@ const (
 )
 
 type Node struct {
-	name  string
-	edges []*Node
+	name       string
+	edges      []*Node
+	dependents map[string]*Node
 }
 
+//Nodes keyed by name, versioned names such as openssl@3 are also indexed under their bare
+//name so dependencies can be resolved against every indexed version
 type TreeGraph struct {
-	tree map[string]*Node
+	tree     map[string]*Node
+	versions map[string]map[string]*Node
+}
+
+//Returned by Add when some of the dependencies of Name are not in the graph
+type MissingDependenciesError struct {
+	Name    string
+	Missing []string
+}
+
+func (e *MissingDependenciesError) Error() string {
+	return fmt.Sprintf("%s:%s", NODE_NOT_FOUND, strings.Join(e.Missing, ","))
+}
+
+//Returned by Add when the new dependencies of Name would make it depend on itself, Cycle
+//lists the path starting and ending with Name
+type CycleError struct {
+	Name  string
+	Cycle []string
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("Dependency cycle:%s", strings.Join(e.Cycle, "->"))
+}
+
+//Returned by Remove when other nodes still depend on Name
+type DependentsExistError struct {
+	Name       string
+	Dependents []string
+}
+
+func (e *DependentsExistError) Error() string {
+	return fmt.Sprintf("Dependency with:%s exists cannot remove:%s", strings.Join(e.Dependents, ","), e.Name)
 }
 
 //Creates an empty TreeGraph type
 func NewGraph() (*TreeGraph, error) {
 
 	return &TreeGraph{
-		tree: make(map[string]*Node),
+		tree:     make(map[string]*Node),
+		versions: make(map[string]map[string]*Node),
 	}, nil
 }
 
@@ -41,73 +79,338 @@ func (g *TreeGraph) Exists(name string) bool {
 	return exists
 }
 
-//Performs actual insert/update against graph
-func (g *TreeGraph) addNode(node *Node) {
-	g.tree[node.name] = node
-	g.addEdge(node)
+//Returns every indexed name for the bare name given, the unversioned name first when indexed
+//followed by each version from lowest to highest, equal versions ordered by name
+func (g *TreeGraph) Versions(name string) []string {
+	var names []string
+	if g.Exists(name) {
+		names = append(names, name)
+	}
+
+	for _, node := range g.sortedVersions(name) {
+		names = append(names, node.name)
+	}
+
+	return names
+}
+
+func (g *TreeGraph) sortedVersions(name string) []*Node {
+	versioned := g.versions[name]
+
+	nodes := make([]*Node, 0, len(versioned))
+	for _, node := range versioned {
+		nodes = append(nodes, node)
+	}
+
+	//Versions comparing equal such as 1 and 1.0 are ordered by name so they always resolve
+	//the same way
+	sort.Slice(nodes, func(i, j int) bool {
+		_, a := SplitVersion(nodes[i].name)
+		_, b := SplitVersion(nodes[j].name)
+		if cmp := CompareVersions(a, b); cmp != 0 {
+			return cmp < 0
+		}
+		return nodes[i].name < nodes[j].name
+	})
+
+	return nodes
+}
+
+//Finds the node a dependency spec refers to. A bare name prefers the unversioned node and
+//falls back to its highest version, constraints pick the highest version satisfying them
+func (g *TreeGraph) resolve(spec string) (*Node, bool) {
+
+	if node, exists := g.tree[spec]; exists {
+		return node, true
+	}
+
+	dependency, err := ParseDependency(spec)
+	if err != nil {
+		return nil, false
+	}
+
+	candidates := g.sortedVersions(dependency.Name)
+	for idx := len(candidates) - 1; idx >= 0; idx-- {
+		_, version := SplitVersion(candidates[idx].name)
+		if dependency.Matches(version) {
+			return candidates[idx], true
+		}
+	}
+
+	return nil, false
+}
+
+//Returns the names of the nodes name depends on in the order they were indexed
+func (g *TreeGraph) Dependencies(name string) ([]string, error) {
+	node, exists := g.tree[name]
+	if !exists {
+		return nil, errors.New(fmt.Sprintf("%s:%s", NODE_NOT_FOUND, name))
+	}
+
+	return edgeNames(node), nil
+}
+
+//Returns the names of the nodes that directly depend on name sorted alphabetically
+func (g *TreeGraph) Dependents(name string) ([]string, error) {
+	node, exists := g.tree[name]
+	if !exists {
+		return nil, errors.New(fmt.Sprintf("%s:%s", NODE_NOT_FOUND, name))
+	}
+
+	return dependentNames(node), nil
+}
+
+//Returns the names of every node that directly or indirectly depends on name. Each node is
+//listed before anything it depends on, so removing them in order never fails
+func (g *TreeGraph) TransitiveDependents(name string) ([]string, error) {
+	node, exists := g.tree[name]
+	if !exists {
+		return nil, errors.New(fmt.Sprintf("%s:%s", NODE_NOT_FOUND, name))
+	}
+
+	var order []string
+	visited := map[string]bool{name: true}
+
+	var visit func(node *Node)
+	visit = func(node *Node) {
+		for _, dependent := range dependentNames(node) {
+			if visited[dependent] {
+				continue
+			}
+			visited[dependent] = true
+
+			visit(g.tree[dependent])
+			order = append(order, dependent)
+		}
+	}
+	visit(node)
+
+	return order, nil
+}
+
+//Returns name and every node it directly or indirectly depends on, each node is listed after
+//all of its dependencies so they can be installed in order. Ties are broken alphabetically
+//so the same graph always gives the same order
+func (g *TreeGraph) Order(name string) ([]string, error) {
+	node, exists := g.tree[name]
+	if !exists {
+		return nil, errors.New(fmt.Sprintf("%s:%s", NODE_NOT_FOUND, name))
+	}
+
+	var order []string
+	g.walkNode(node, make(map[string]bool), func(name string, edges []string) error {
+		order = append(order, name)
+		return nil
+	})
+
+	return order, nil
+}
+
+//Performs actual insert/update against graph, an existing node keeps its dependents
+//while its previous dependencies are unlinked and replaced by the new ones
+func (g *TreeGraph) addNode(name string, edgeNodes []*Node) {
+	node, exists := g.tree[name]
+	if exists {
+		g.removeEdges(node)
+	} else {
+		node = &Node{
+			name:       name,
+			dependents: make(map[string]*Node),
+		}
+		g.tree[name] = node
+
+		if base, version := SplitVersion(name); version != "" {
+			if g.versions[base] == nil {
+				g.versions[base] = make(map[string]*Node)
+			}
+			g.versions[base][name] = node
+		}
+	}
+
+	node.edges = edgeNodes
+	g.addEdges(node)
 }
 
 //Attempts to add new name, will check that dependencies exist if all exist node will be added,
-//otherwise and error is returned
+//otherwise a MissingDependenciesError listing every missing dependency is returned. Each
+//dependency may be a spec such as openssl@3 or libfoo>=1.2,<2 and is resolved to the highest
+//indexed version satisfying it. Re-adding an existing name with dependencies that lead back
+//to it returns a CycleError
 func (g *TreeGraph) Add(name string, edges ...string) error {
 
 	var edgeNodes []*Node
+	var missing []string
 
-	if len(edges) >= 1 {
-		for _, edge := range edges {
-			n, err := g.Get(edge)
-			if err == nil {
-				edgeNodes = append(edgeNodes, &n)
-			} else {
-				return errors.New(fmt.Sprintf("%s:%s", NODE_NOT_FOUND, edge))
-			}
+	for _, edge := range edges {
+		n, exists := g.resolve(edge)
+		if !exists {
+			missing = append(missing, edge)
+			continue
 		}
+		edgeNodes = append(edgeNodes, n)
 	}
 
-	tempNode := &Node{
-		name:  name,
-		edges: edgeNodes,
+	if len(missing) > 0 {
+		return &MissingDependenciesError{Name: name, Missing: missing}
 	}
 
-	g.addNode(tempNode)
+	//Nothing can depend on a new node yet, only re-adding one can close a cycle
+	if _, exists := g.tree[name]; exists {
+		for _, edgeNode := range edgeNodes {
+			if path := g.pathTo(edgeNode, name, make(map[string]bool)); path != nil {
+				return &CycleError{Name: name, Cycle: append([]string{name}, path...)}
+			}
+		}
+	}
+
+	g.addNode(name, edgeNodes)
 	return nil
 }
 
 //Performs removal of node
 func (g *TreeGraph) removeNode(name string) {
 	delete(g.tree, name)
+
+	if base, version := SplitVersion(name); version != "" {
+		delete(g.versions[base], name)
+		if len(g.versions[base]) == 0 {
+			delete(g.versions, base)
+		}
+	}
 }
 
-//Attempts to remove name from graph as long as no dependencies require it
+//Attempts to remove name from graph as long as no other node depends on it, otherwise a
+//DependentsExistError listing the dependents is returned
 func (g *TreeGraph) Remove(name string) error {
 
-	if g.Exists(name) {
-		for _, edge := range g.tree[name].edges {
-			if g.Exists(edge.name) {
-				for _, e := range edge.edges {
-					if e.name == name {
-						return errors.New(fmt.Sprintf("Dependency with:%s exists cannot remove:%s", edge.name, name))
-					}
-				}
-
-			} else {
-				continue
-			}
+	node, exists := g.tree[name]
+	if !exists {
+		return nil
+	}
+
+	if len(node.dependents) > 0 {
+		return &DependentsExistError{Name: name, Dependents: dependentNames(node)}
+	}
+
+	g.removeEdges(node)
+	g.removeNode(name)
+	return nil
+}
+
+//Links node as a dependent of each of its edges
+func (g *TreeGraph) addEdges(node *Node) {
+	for _, edgeNode := range node.edges {
+		edgeNode.dependents[node.name] = node
+	}
+}
+
+//Unlinks node as a dependent of each of its edges
+func (g *TreeGraph) removeEdges(node *Node) {
+	for _, edgeNode := range node.edges {
+		delete(edgeNode.dependents, node.name)
+	}
+}
+
+//Returns the number of nodes in the graph
+func (g *TreeGraph) Len() int {
+	return len(g.tree)
+}
+
+//Returns the number of dependency edges between nodes in the graph
+func (g *TreeGraph) EdgeCount() int {
+	var count int
+	for _, node := range g.tree {
+		count += len(node.edges)
+	}
+
+	return count
+}
+
+//Returns every name in the graph sorted alphabetically
+func (g *TreeGraph) Names() []string {
+	names := make([]string, 0, len(g.tree))
+	for name := range g.tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+//Visits every node after all of its dependencies have been visited, ties are broken
+//alphabetically so the same graph is always walked in the same order. Stops at the
+//first error returned by fn
+func (g *TreeGraph) Walk(fn func(name string, edges []string) error) error {
+	visited := make(map[string]bool, len(g.tree))
+
+	for _, name := range g.Names() {
+		if err := g.walkNode(g.tree[name], visited, fn); err != nil {
+			return err
 		}
-		g.removeNode(name)
+	}
+
+	return nil
+}
+
+//Depth first post-order visit of node, dependencies are visited alphabetically
+func (g *TreeGraph) walkNode(node *Node, visited map[string]bool, fn func(name string, edges []string) error) error {
+	if visited[node.name] {
 		return nil
-	} else {
+	}
+	visited[node.name] = true
+
+	edges := edgeNames(node)
+	sortedEdges := make([]string, len(edges))
+	copy(sortedEdges, edges)
+	sort.Strings(sortedEdges)
+
+	for _, edge := range sortedEdges {
+		if err := g.walkNode(g.tree[edge], visited, fn); err != nil {
+			return err
+		}
+	}
+
+	return fn(node.name, edges)
+}
+
+//Returns the names from node to target following dependencies, or nil when target can't be
+//reached from node
+func (g *TreeGraph) pathTo(node *Node, target string, visited map[string]bool) []string {
+	if node.name == target {
+		return []string{target}
+	}
+
+	if visited[node.name] {
 		return nil
 	}
+	visited[node.name] = true
+
+	for _, edge := range node.edges {
+		if path := g.pathTo(edge, target, visited); path != nil {
+			return append([]string{node.name}, path...)
+		}
+	}
 
+	return nil
 }
 
-//Links nodes together as edges
-func (g *TreeGraph) addEdge(node *Node) {
-	var temp []*Node
+//Returns the names of the nodes that depend on node sorted alphabetically
+func dependentNames(node *Node) []string {
+	names := make([]string, 0, len(node.dependents))
+	for name := range node.dependents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
 
-	for _, edgeNode := range node.edges {
-		edgeNode.edges = temp
-		edgeNode.edges = append(edgeNode.edges, node)
+//Returns the names of the nodes node depends on in the order they were indexed
+func edgeNames(node *Node) []string {
+	names := make([]string, 0, len(node.edges))
+	for _, edge := range node.edges {
+		names = append(names, edge.name)
 	}
+
+	return names
 }
@@ -1,6 +1,7 @@
 package graph
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -63,6 +64,162 @@ func TestAdd(t *testing.T) {
 
 }
 
+func TestDependencies(t *testing.T) {
+
+	g := newGraph(t)
+	g.Add("gmp")
+	g.Add("isl", "gmp")
+	g.Add("pkg-config")
+	g.Add("cloog", "gmp", "isl", "pkg-config")
+
+	var tests = []struct {
+		name           string
+		expected       string
+		errShouldBeNil bool
+	}{
+		{name: "gmp", expected: "", errShouldBeNil: true},
+		{name: "isl", expected: "gmp", errShouldBeNil: true},
+		{name: "cloog", expected: "gmp,isl,pkg-config", errShouldBeNil: true},
+		{name: "boo", expected: "", errShouldBeNil: false},
+	}
+
+	for _, test := range tests {
+		dependencies, err := g.Dependencies(test.name)
+
+		if (err == nil) != test.errShouldBeNil {
+			t.Errorf("Dependencies(%q) = %v", test.name, err)
+		}
+
+		if strings.Join(dependencies, ",") != test.expected {
+			t.Errorf("Dependencies(%q) = %q, expected:%q", test.name, dependencies, test.expected)
+		}
+	}
+}
+
+func TestDependents(t *testing.T) {
+
+	g := newGraph(t)
+	g.Add("gmp")
+	g.Add("isl", "gmp")
+	g.Add("pkg-config")
+	g.Add("cloog", "gmp", "isl", "pkg-config")
+	g.Add("gcc", "cloog", "isl")
+
+	var tests = []struct {
+		name               string
+		expected           string
+		expectedTransitive string
+		errShouldBeNil     bool
+	}{
+		{name: "gcc", expected: "", expectedTransitive: "", errShouldBeNil: true},
+		{name: "pkg-config", expected: "cloog", expectedTransitive: "gcc,cloog", errShouldBeNil: true},
+		{name: "isl", expected: "cloog,gcc", expectedTransitive: "gcc,cloog", errShouldBeNil: true},
+		{name: "gmp", expected: "cloog,isl", expectedTransitive: "gcc,cloog,isl", errShouldBeNil: true},
+		{name: "boo", expected: "", expectedTransitive: "", errShouldBeNil: false},
+	}
+
+	for _, test := range tests {
+		dependents, err := g.Dependents(test.name)
+		if (err == nil) != test.errShouldBeNil {
+			t.Errorf("Dependents(%q) = %v", test.name, err)
+		}
+		if strings.Join(dependents, ",") != test.expected {
+			t.Errorf("Dependents(%q) = %q, expected:%q", test.name, dependents, test.expected)
+		}
+
+		transitive, err := g.TransitiveDependents(test.name)
+		if (err == nil) != test.errShouldBeNil {
+			t.Errorf("TransitiveDependents(%q) = %v", test.name, err)
+		}
+		if strings.Join(transitive, ",") != test.expectedTransitive {
+			t.Errorf("TransitiveDependents(%q) = %q, expected:%q", test.name, transitive, test.expectedTransitive)
+		}
+	}
+
+	transitive, _ := g.TransitiveDependents("gmp")
+	for _, name := range append(transitive, "gmp") {
+		if err := g.Remove(name); err != nil {
+			t.Errorf("Removing in TransitiveDependents order failed at %q: %v", name, err)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+
+	g := newGraph(t)
+	g.Add("gmp")
+	g.Add("isl", "gmp")
+
+	err := g.Add("cloog", "gmp", "isl", "pkg-config", "ppl")
+	missing, ok := err.(*MissingDependenciesError)
+	if !ok {
+		t.Fatalf("Add() = %#v, expected:*MissingDependenciesError", err)
+	}
+	if strings.Join(missing.Missing, ",") != "pkg-config,ppl" {
+		t.Errorf("MissingDependenciesError.Missing = %q", missing.Missing)
+	}
+
+	err = g.Remove("gmp")
+	dependents, ok := err.(*DependentsExistError)
+	if !ok {
+		t.Fatalf("Remove() = %#v, expected:*DependentsExistError", err)
+	}
+	if strings.Join(dependents.Dependents, ",") != "isl" {
+		t.Errorf("DependentsExistError.Dependents = %q", dependents.Dependents)
+	}
+}
+
+func TestOrder(t *testing.T) {
+
+	g := newGraph(t)
+	g.Add("zlib")
+	g.Add("gmp")
+	g.Add("pkg-config")
+	g.Add("isl", "gmp")
+	g.Add("cloog", "pkg-config", "isl", "gmp")
+	g.Add("gcc", "zlib", "cloog")
+
+	var tests = []struct {
+		name           string
+		expected       string
+		errShouldBeNil bool
+	}{
+		{name: "gmp", expected: "gmp", errShouldBeNil: true},
+		{name: "isl", expected: "gmp,isl", errShouldBeNil: true},
+		{name: "cloog", expected: "gmp,isl,pkg-config,cloog", errShouldBeNil: true},
+		{name: "gcc", expected: "gmp,isl,pkg-config,cloog,zlib,gcc", errShouldBeNil: true},
+		{name: "boo", expected: "", errShouldBeNil: false},
+	}
+
+	for _, test := range tests {
+		order, err := g.Order(test.name)
+		if (err == nil) != test.errShouldBeNil {
+			t.Errorf("Order(%q) = %v", test.name, err)
+		}
+
+		if strings.Join(order, ",") != test.expected {
+			t.Errorf("Order(%q) = %q, expected:%q", test.name, order, test.expected)
+		}
+	}
+}
+
+func TestLen(t *testing.T) {
+
+	g := newGraph(t)
+	g.Add("gmp")
+	g.Add("isl", "gmp")
+	g.Add("cloog", "gmp", "isl")
+	g.Add("isl")
+
+	if g.Len() != 3 {
+		t.Errorf("Len() = %d, expected:3", g.Len())
+	}
+
+	if g.EdgeCount() != 2 {
+		t.Errorf("EdgeCount() = %d, expected:2", g.EdgeCount())
+	}
+}
+
 func TestRemoveEmpty(t *testing.T) {
 	g := newGraph(t)
 	var errResult bool
@@ -113,10 +270,11 @@ func TestRemove(t *testing.T) {
 	}{
 		{name: "boo", errShouldBeNil: true},
 		{name: "foo", errShouldBeNil: true},
-		{name: "zap", errShouldBeNil: false},
+		{name: "bar", errShouldBeNil: false},
+		{name: "bar2", errShouldBeNil: false},
+		{name: "zap", errShouldBeNil: true},
 		{name: "bar", errShouldBeNil: true},
 		{name: "bar2", errShouldBeNil: true},
-		{name: "zap", errShouldBeNil: true},
 	}
 
 	for _, p := range addPackages {
@@ -137,3 +295,339 @@ func TestRemove(t *testing.T) {
 		}
 	}
 }
+
+func TestRemoveMultipleDependents(t *testing.T) {
+	g := newGraph(t)
+
+	var errResult bool
+	var addPackages = []struct {
+		name  string
+		edges []string
+	}{
+		{name: "gmp"},
+		{name: "isl", edges: []string{"gmp"}},
+		{name: "cloog", edges: []string{"gmp", "isl"}},
+		{name: "isl", edges: []string{"gmp"}},
+	}
+
+	var removePackages = []struct {
+		name           string
+		errShouldBeNil bool
+	}{
+		{name: "gmp", errShouldBeNil: false},
+		{name: "isl", errShouldBeNil: false},
+		{name: "cloog", errShouldBeNil: true},
+		{name: "gmp", errShouldBeNil: false},
+		{name: "isl", errShouldBeNil: true},
+		{name: "gmp", errShouldBeNil: true},
+	}
+
+	for _, p := range addPackages {
+		if err := g.Add(p.name, p.edges...); err != nil {
+			t.Fatalf("Add(%q, %q) = %v", p.name, p.edges, err)
+		}
+	}
+
+	for _, test := range removePackages {
+		err := g.Remove(test.name)
+
+		if err == nil {
+			errResult = true
+		} else {
+			errResult = false
+		}
+
+		if errResult != test.errShouldBeNil {
+			t.Errorf("Remove(%q) = %v", test.name, err)
+		}
+	}
+}
+
+func TestRemoveAfterReindex(t *testing.T) {
+	g := newGraph(t)
+
+	g.Add("foo")
+	g.Add("bar")
+	g.Add("boo", "foo")
+	g.Add("boo", "bar")
+
+	if err := g.Remove("foo"); err != nil {
+		t.Errorf("Remove(%q) = %v, foo is no longer a dependency of boo", "foo", err)
+	}
+
+	if err := g.Remove("bar"); err == nil {
+		t.Errorf("Remove(%q) should fail, boo depends on bar", "bar")
+	}
+
+	g.Add("bar")
+	if err := g.Remove("bar"); err == nil {
+		t.Errorf("Remove(%q) should fail, re-indexing bar should keep its dependents", "bar")
+	}
+}
+
+func TestWalk(t *testing.T) {
+	g := newGraph(t)
+
+	g.Add("gmp")
+	g.Add("zlib")
+	g.Add("isl", "gmp")
+	g.Add("cloog", "isl", "gmp")
+	g.Add("apr", "zlib")
+
+	var visited []string
+	err := g.Walk(func(name string, edges []string) error {
+		visited = append(visited, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"zlib", "apr", "gmp", "isl", "cloog"}
+	if strings.Join(visited, ",") != strings.Join(expected, ",") {
+		t.Errorf("Walk() = %q, expected:%q", visited, expected)
+	}
+}
+
+func TestCycles(t *testing.T) {
+
+	type add struct {
+		name  string
+		edges []string
+	}
+
+	var tests = []struct {
+		shape         string
+		setup         []add
+		add           add
+		expectedErr   string
+		expectedCycle string
+	}{
+		{
+			shape: "self dependency",
+			setup: []add{{name: "a"}},
+			add:   add{name: "a", edges: []string{"a"}}, expectedErr: "cycle", expectedCycle: "a,a",
+		},
+		{
+			shape: "new self dependency",
+			setup: []add{},
+			add:   add{name: "a", edges: []string{"a"}}, expectedErr: "missing",
+		},
+		{
+			shape: "two node cycle",
+			setup: []add{{name: "a"}, {name: "b", edges: []string{"a"}}},
+			add:   add{name: "a", edges: []string{"b"}}, expectedErr: "cycle", expectedCycle: "a,b,a",
+		},
+		{
+			shape: "chain",
+			setup: []add{{name: "a"}, {name: "b", edges: []string{"a"}}, {name: "c", edges: []string{"b"}}},
+			add:   add{name: "d", edges: []string{"c"}},
+		},
+		{
+			shape: "chain closed into a cycle",
+			setup: []add{{name: "a"}, {name: "b", edges: []string{"a"}}, {name: "c", edges: []string{"b"}}, {name: "d", edges: []string{"c"}}},
+			add:   add{name: "a", edges: []string{"d"}}, expectedErr: "cycle", expectedCycle: "a,d,c,b,a",
+		},
+		{
+			shape: "chain re-indexed further down",
+			setup: []add{{name: "a"}, {name: "b", edges: []string{"a"}}, {name: "c", edges: []string{"b"}}, {name: "d"}},
+			add:   add{name: "a", edges: []string{"d"}},
+		},
+		{
+			shape: "diamond",
+			setup: []add{{name: "a"}, {name: "b", edges: []string{"a"}}, {name: "c", edges: []string{"a"}}},
+			add:   add{name: "d", edges: []string{"b", "c"}},
+		},
+		{
+			shape: "diamond re-indexed with shared dependency",
+			setup: []add{{name: "a"}, {name: "b", edges: []string{"a"}}, {name: "c", edges: []string{"a"}}, {name: "d", edges: []string{"b", "c"}}},
+			add:   add{name: "d", edges: []string{"a", "b", "c"}},
+		},
+		{
+			shape: "diamond closed into a cycle",
+			setup: []add{{name: "a"}, {name: "b", edges: []string{"a"}}, {name: "c", edges: []string{"a"}}, {name: "d", edges: []string{"b", "c"}}},
+			add:   add{name: "a", edges: []string{"d"}}, expectedErr: "cycle", expectedCycle: "a,d,b,a",
+		},
+		{
+			shape: "diamond side re-indexed into a cycle",
+			setup: []add{{name: "a"}, {name: "b", edges: []string{"a"}}, {name: "c", edges: []string{"a"}}, {name: "d", edges: []string{"b", "c"}}},
+			add:   add{name: "c", edges: []string{"a", "d"}}, expectedErr: "cycle", expectedCycle: "c,d,c",
+		},
+	}
+
+	for _, test := range tests {
+		g := newGraph(t)
+		for _, a := range test.setup {
+			if err := g.Add(a.name, a.edges...); err != nil {
+				t.Fatalf("%s: setup Add(%q, %q) = %v", test.shape, a.name, a.edges, err)
+			}
+		}
+
+		previous, _ := g.Dependencies(test.add.name)
+		err := g.Add(test.add.name, test.add.edges...)
+
+		switch e := err.(type) {
+		case nil:
+			if test.expectedErr != "" {
+				t.Errorf("%s: Add(%q, %q) = nil, expected:%s", test.shape, test.add.name, test.add.edges, test.expectedErr)
+			}
+		case *CycleError:
+			if test.expectedErr != "cycle" {
+				t.Errorf("%s: Add(%q, %q) = %v, expected:%s", test.shape, test.add.name, test.add.edges, err, test.expectedErr)
+			}
+			if strings.Join(e.Cycle, ",") != test.expectedCycle {
+				t.Errorf("%s: CycleError.Cycle = %q, expected:%q", test.shape, e.Cycle, test.expectedCycle)
+			}
+		case *MissingDependenciesError:
+			if test.expectedErr != "missing" {
+				t.Errorf("%s: Add(%q, %q) = %v, expected:%s", test.shape, test.add.name, test.add.edges, err, test.expectedErr)
+			}
+		default:
+			t.Errorf("%s: Add(%q, %q) = %v, unexpected error", test.shape, test.add.name, test.add.edges, err)
+		}
+
+		if err != nil {
+			current, _ := g.Dependencies(test.add.name)
+			if strings.Join(current, ",") != strings.Join(previous, ",") {
+				t.Errorf("%s: rejected Add changed dependencies of %q to %q", test.shape, test.add.name, current)
+			}
+		}
+
+		if err := g.Walk(func(name string, edges []string) error { return nil }); err != nil {
+			t.Errorf("%s: Walk() = %v", test.shape, err)
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+
+	g := newGraph(t)
+	for _, name := range []string{"openssl@1.1", "openssl@3", "openssl@1.10", "libfoo@1.2", "libfoo@1.9.1", "libfoo@2.0", "libfoo@2", "zlib", "zlib@1.3"} {
+		if err := g.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		dependency string
+		expected   string
+	}{
+		{"openssl", "openssl@3"},
+		{"openssl@1.1", "openssl@1.1"},
+		{"openssl<3", "openssl@1.10"},
+		{"openssl>=1.1,<1.10", "openssl@1.1"},
+		{"libfoo>=1.2,<2", "libfoo@1.9.1"},
+		{"libfoo!=2.0", "libfoo@1.9.1"},
+		{"libfoo==1.2", "libfoo@1.2"},
+		{"libfoo=2", "libfoo@2.0"},
+		{"libfoo>=2", "libfoo@2.0"},
+		{"libfoo>2", ""},
+		{"libfoo@1.3", ""},
+		{"zlib", "zlib"},
+		{"zlib>1", "zlib@1.3"},
+		{"missing", ""},
+		{"missing>=1", ""},
+	}
+
+	//Repeated so equal versions resolving by chance would show
+	for idx := 0; idx < 20*len(tests); idx++ {
+		test := tests[idx%len(tests)]
+		err := g.Add("app", test.dependency)
+
+		if test.expected == "" {
+			e, ok := err.(*MissingDependenciesError)
+			if !ok || strings.Join(e.Missing, ",") != test.dependency {
+				t.Errorf("Add(app, %q) = %v, expected it to be missing", test.dependency, err)
+			}
+			continue
+		}
+
+		dependencies, _ := g.Dependencies("app")
+		if err != nil || strings.Join(dependencies, ",") != test.expected {
+			t.Errorf("Add(app, %q) = %v resolved to %q, expected:%q", test.dependency, err, dependencies, test.expected)
+		}
+	}
+
+	if versions := strings.Join(g.Versions("openssl"), ","); versions != "openssl@1.1,openssl@1.10,openssl@3" {
+		t.Errorf("Versions(openssl) = %q", versions)
+	}
+
+	if versions := strings.Join(g.Versions("libfoo"), ","); versions != "libfoo@1.2,libfoo@1.9.1,libfoo@2,libfoo@2.0" {
+		t.Errorf("Versions(libfoo) = %q", versions)
+	}
+
+	if versions := strings.Join(g.Versions("zlib"), ","); versions != "zlib,zlib@1.3" {
+		t.Errorf("Versions(zlib) = %q", versions)
+	}
+
+	g.Remove("app")
+	g.Remove("openssl@3")
+	if err := g.Add("app", "openssl"); err != nil {
+		t.Fatal(err)
+	}
+	if dependencies, _ := g.Dependencies("app"); strings.Join(dependencies, ",") != "openssl@1.10" {
+		t.Errorf("Removed version should no longer be resolved, Got:%q", dependencies)
+	}
+}
+
+func TestParseDependency(t *testing.T) {
+
+	var tests = []struct {
+		spec        string
+		name        string
+		constraints string
+		valid       bool
+	}{
+		{"gmp", "gmp", "", true},
+		{"openssl@3", "openssl", "=3", true},
+		{"libfoo>=1.2,<2", "libfoo", ">=1.2<2", true},
+		{"libfoo!=1.0", "libfoo", "!=1.0", true},
+		{"openssl@", "", "", false},
+		{"openssl@3,<4", "", "", false},
+		{"libfoo>=", "", "", false},
+		{"libfoo>=1.2,2", "", "", false},
+		{">=1.2", "", "", false},
+		{"libfoo=>1.2", "", "", false},
+	}
+
+	for _, test := range tests {
+		d, err := ParseDependency(test.spec)
+		if (err == nil) != test.valid {
+			t.Errorf("ParseDependency(%q) = %v, expected valid:%v", test.spec, err, test.valid)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		var constraints string
+		for _, c := range d.Constraints {
+			constraints += c.Op + c.Version
+		}
+
+		if d.Name != test.name || constraints != test.constraints {
+			t.Errorf("ParseDependency(%q) = %s %s, expected:%s %s", test.spec, d.Name, constraints, test.name, test.constraints)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+
+	var tests = []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.2", "1.10", -1},
+		{"2", "2.0", 0},
+		{"3", "1.1", 1},
+		{"1.0.1", "1.0", 1},
+		{"1.0a", "1.0b", -1},
+		{"1.2", "1.2", 0},
+	}
+
+	for _, test := range tests {
+		if result := CompareVersions(test.a, test.b); result != test.expected {
+			t.Errorf("CompareVersions(%q, %q) = %d, expected:%d", test.a, test.b, result, test.expected)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	VERSION_SEPARATOR string = "@"
+	CONSTRAINT_CHARS  string = "<>=!"
+)
+
+var versionCharacters = regexp.MustCompile(`^[a-zA-Z0-9\_\-\+\.]+$`)
+
+//Operators a dependency constraint may use, longest first so >= is not read as >
+var constraintOperators = []string{">=", "<=", "!=", "==", ">", "<", "="}
+
+//Requirement on the version of a dependency such as >=1.2
+type Constraint struct {
+	Op      string
+	Version string
+}
+
+//Dependency as written in INDEX, a package name optionally pinned with @version or followed
+//by comma separated constraints, e.g. gmp, openssl@3 or libfoo>=1.2,<2
+type Dependency struct {
+	Name        string
+	Constraints []Constraint
+}
+
+//Splits openssl@3 into openssl and 3, names without a version are returned unchanged with an
+//empty version
+func SplitVersion(name string) (string, string) {
+	idx := strings.Index(name, VERSION_SEPARATOR)
+	if idx < 0 {
+		return name, ""
+	}
+
+	return name[:idx], name[idx+1:]
+}
+
+//Splits a package name into its name and version, failing when the version given after @ is
+//empty or holds characters other than a-zA-Z0-9_-+.
+func ParsePackage(name string) (string, string, error) {
+	base, version := SplitVersion(name)
+	if strings.Contains(name, VERSION_SEPARATOR) && !versionCharacters.MatchString(version) {
+		return "", "", errors.New(fmt.Sprintf("Invalid version:%s", name))
+	}
+
+	return base, version, nil
+}
+
+//Parses a dependency spec such as gmp, openssl@3 or libfoo>=1.2,<2
+func ParseDependency(spec string) (*Dependency, error) {
+
+	idx := strings.IndexAny(spec, VERSION_SEPARATOR+CONSTRAINT_CHARS)
+	if idx < 0 {
+		return &Dependency{Name: spec}, nil
+	}
+
+	dependency := &Dependency{Name: spec[:idx]}
+	if dependency.Name == "" {
+		return nil, errors.New(fmt.Sprintf("Invalid dependency:%s", spec))
+	}
+
+	if spec[idx:idx+1] == VERSION_SEPARATOR {
+		_, version, err := ParsePackage(spec)
+		if err != nil {
+			return nil, err
+		}
+		dependency.Constraints = []Constraint{{Op: "=", Version: version}}
+		return dependency, nil
+	}
+
+	for _, item := range strings.Split(spec[idx:], ",") {
+		constraint, err := parseConstraint(item)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid dependency:%s %v", spec, err))
+		}
+		dependency.Constraints = append(dependency.Constraints, constraint)
+	}
+
+	return dependency, nil
+}
+
+func parseConstraint(item string) (Constraint, error) {
+	for _, op := range constraintOperators {
+		if !strings.HasPrefix(item, op) {
+			continue
+		}
+
+		version := strings.TrimPrefix(item, op)
+		if !versionCharacters.MatchString(version) {
+			return Constraint{}, errors.New(fmt.Sprintf("Invalid constraint:%s", item))
+		}
+		return Constraint{Op: op, Version: version}, nil
+	}
+
+	return Constraint{}, errors.New(fmt.Sprintf("Invalid constraint:%s", item))
+}
+
+//Reports whether version satisfies every constraint of the dependency
+func (d *Dependency) Matches(version string) bool {
+	for _, c := range d.Constraints {
+		cmp := CompareVersions(version, c.Version)
+
+		var ok bool
+		switch c.Op {
+		case ">=":
+			ok = cmp >= 0
+		case "<=":
+			ok = cmp <= 0
+		case ">":
+			ok = cmp > 0
+		case "<":
+			ok = cmp < 0
+		case "!=":
+			ok = cmp != 0
+		default:
+			ok = cmp == 0
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+//Compares two dot separated versions segment by segment returning -1, 0 or 1. Numeric
+//segments compare as numbers and anything else alphabetically, missing segments count as 0
+//so 2 and 2.0 are equal
+func CompareVersions(a, b string) int {
+
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+
+	for idx := 0; idx < len(as) || idx < len(bs); idx++ {
+		x, y := "0", "0"
+		if idx < len(as) {
+			x = as[idx]
+		}
+		if idx < len(bs) {
+			y = bs[idx]
+		}
+
+		xn, xErr := strconv.Atoi(x)
+		yn, yErr := strconv.Atoi(y)
+
+		switch {
+		case xErr == nil && yErr == nil && xn != yn:
+			if xn < yn {
+				return -1
+			}
+			return 1
+		case (xErr != nil || yErr != nil) && x != y:
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return 0
+}
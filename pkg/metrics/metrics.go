@@ -0,0 +1,279 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	counterType   string = "counter"
+	gaugeType     string = "gauge"
+	histogramType string = "histogram"
+)
+
+//Buckets in seconds suited to timing in-memory operations and lock waits
+var LatencyBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+var labelValueEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+//Registry every metric created through the package level constructors is added to
+var DefaultRegistry = NewRegistry()
+
+//Collection of metrics written out in the Prometheus text exposition format
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+//A metric name with its help text, type and one value per combination of label values
+type family struct {
+	name       string
+	help       string
+	metricType string
+	labels     []string
+	buckets    []float64
+	valueFunc  func() float64
+	mu         sync.Mutex
+	values     map[string]*value
+}
+
+//Current state of a single labelled metric, histograms also keep per bucket counts
+type value struct {
+	labelValues []string
+	value       float64
+	sum         float64
+	count       uint64
+	buckets     []uint64
+}
+
+//Counts occurrences per combination of label values
+type CounterVec struct {
+	family *family
+}
+
+//Value that can go up and down
+type Gauge struct {
+	family *family
+}
+
+//Counts observations into cumulative buckets per combination of label values
+type HistogramVec struct {
+	family *family
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{family: r.register(name, help, counterType, labels, nil, nil)}
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{family: r.register(name, help, gaugeType, nil, nil, nil)}
+	g.Add(0)
+	return g
+}
+
+//Registers a gauge whose value is read from fn every time the registry is written
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(name, help, gaugeType, nil, nil, fn)
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{family: r.register(name, help, histogramType, labels, buckets, nil)}
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return DefaultRegistry.NewCounterVec(name, help, labels...)
+}
+
+func NewGauge(name, help string) *Gauge {
+	return DefaultRegistry.NewGauge(name, help)
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) {
+	DefaultRegistry.NewGaugeFunc(name, help, fn)
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return DefaultRegistry.NewHistogramVec(name, help, buckets, labels...)
+}
+
+func (r *Registry) register(name, help, metricType string, labels []string, buckets []float64, fn func() float64) *family {
+
+	f := &family{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labels:     labels,
+		buckets:    buckets,
+		valueFunc:  fn,
+		values:     make(map[string]*value),
+	}
+
+	r.mu.Lock()
+	r.families = append(r.families, f)
+	r.mu.Unlock()
+
+	return f
+}
+
+//Adds one to the counter for labelValues, given in the order the labels were declared
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.family.update(labelValues, func(v *value) {
+		v.value++
+	})
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.family.update(nil, func(v *value) {
+		v.value += delta
+	})
+}
+
+func (g *Gauge) Set(current float64) {
+	g.family.update(nil, func(v *value) {
+		v.value = current
+	})
+}
+
+//Records seconds against labelValues, given in the order the labels were declared
+func (h *HistogramVec) Observe(seconds float64, labelValues ...string) {
+	h.family.update(labelValues, func(v *value) {
+		v.sum += seconds
+		v.count++
+		for idx, bound := range h.family.buckets {
+			if seconds <= bound {
+				v.buckets[idx]++
+			}
+		}
+	})
+}
+
+func (f *family) update(labelValues []string, fn func(v *value)) {
+
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.Lock()
+	v, exists := f.values[key]
+	if !exists {
+		v = &value{
+			labelValues: append([]string(nil), labelValues...),
+			buckets:     make([]uint64, len(f.buckets)),
+		}
+		f.values[key] = v
+	}
+	fn(v)
+	f.mu.Unlock()
+}
+
+//Writes every metric in the registry in the Prometheus text exposition format
+func (r *Registry) Write(w io.Writer) error {
+
+	r.mu.Lock()
+	families := make([]*family, len(r.families))
+	copy(families, r.families)
+	r.mu.Unlock()
+
+	var buffer bytes.Buffer
+	for _, f := range families {
+		f.write(&buffer)
+	}
+
+	_, err := buffer.WriteTo(w)
+	return err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+func (f *family) write(buffer *bytes.Buffer) {
+
+	fmt.Fprintf(buffer, "# HELP %s %s\n", f.name, strings.Replace(f.help, "\n", " ", -1))
+	fmt.Fprintf(buffer, "# TYPE %s %s\n", f.name, f.metricType)
+
+	if f.valueFunc != nil {
+		fmt.Fprintf(buffer, "%s %s\n", f.name, formatFloat(f.valueFunc()))
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0, len(f.values))
+	for key := range f.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v := f.values[key]
+		labels := formatLabels(f.labels, v.labelValues)
+
+		if f.metricType != histogramType {
+			fmt.Fprintf(buffer, "%s%s %s\n", f.name, labels, formatFloat(v.value))
+			continue
+		}
+
+		bucketNames := appendCopy(f.labels, "le")
+		for idx, bound := range f.buckets {
+			bucketLabels := formatLabels(bucketNames, appendCopy(v.labelValues, formatFloat(bound)))
+			fmt.Fprintf(buffer, "%s_bucket%s %d\n", f.name, bucketLabels, v.buckets[idx])
+		}
+		infLabels := formatLabels(bucketNames, appendCopy(v.labelValues, "+Inf"))
+		fmt.Fprintf(buffer, "%s_bucket%s %d\n", f.name, infLabels, v.count)
+		fmt.Fprintf(buffer, "%s_sum%s %s\n", f.name, labels, formatFloat(v.sum))
+		fmt.Fprintf(buffer, "%s_count%s %d\n", f.name, labels, v.count)
+	}
+}
+
+//Formats names and values as {name="value",...}, or nothing when there are no labels
+func formatLabels(names, values []string) string {
+
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(names))
+	for idx, name := range names {
+		labelValue := ""
+		if idx < len(values) {
+			labelValue = values[idx]
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, labelValueEscaper.Replace(labelValue)))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+//Returns a new slice holding values followed by extra, leaving values untouched
+func appendCopy(values []string, extra string) []string {
+	result := make([]string, len(values), len(values)+1)
+	copy(result, values)
+	return append(result, extra)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
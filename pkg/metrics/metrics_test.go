@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+
+	r := NewRegistry()
+	commands := r.NewCounterVec("commands_total", "Commands run", "command", "code")
+	connections := r.NewGauge("connections", "Open connections")
+	r.NewGaugeFunc("packages", "Indexed packages", func() float64 { return 3 })
+	latency := r.NewHistogramVec("latency_seconds", "Latency", []float64{0.1, 1}, "mode")
+
+	commands.Inc("INDEX", "OK")
+	commands.Inc("INDEX", "OK")
+	commands.Inc("QUERY", "FAIL")
+	commands.Inc("BAD\"\\\n", "ERROR")
+	connections.Inc()
+	connections.Inc()
+	connections.Dec()
+	latency.Observe(0.05, "read")
+	latency.Observe(0.5, "read")
+	latency.Observe(2, "read")
+
+	var buffer bytes.Buffer
+	if err := r.Write(&buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP commands_total Commands run
+# TYPE commands_total counter
+commands_total{command="BAD\"\\\n",code="ERROR"} 1
+commands_total{command="INDEX",code="OK"} 2
+commands_total{command="QUERY",code="FAIL"} 1
+# HELP connections Open connections
+# TYPE connections gauge
+connections 1
+# HELP packages Indexed packages
+# TYPE packages gauge
+packages 3
+# HELP latency_seconds Latency
+# TYPE latency_seconds histogram
+latency_seconds_bucket{mode="read",le="0.1"} 1
+latency_seconds_bucket{mode="read",le="1"} 2
+latency_seconds_bucket{mode="read",le="+Inf"} 3
+latency_seconds_sum{mode="read"} 2.55
+latency_seconds_count{mode="read"} 3
+`
+
+	if buffer.String() != expected {
+		t.Errorf("Write() = \n%s\nexpected:\n%s", buffer.String(), expected)
+	}
+}
@@ -0,0 +1,232 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jrxfive/packagetree/pkg/graph"
+	"github.com/jrxfive/packagetree/pkg/repomanager"
+	"net"
+	"sync"
+	"time"
+)
+
+//Read only backend replicating the packages of a leader. Queries are answered from a local
+//TreeGraph kept up to date by Run, Add and Remove fail with a repomanager.ReadOnlyError naming
+//the leader's client address. While disconnected the packages last received keep being served.
+type Follower struct {
+	leader            string
+	leaderAddress     string
+	retryInterval     time.Duration
+	heartbeatInterval time.Duration
+	mu                sync.RWMutex
+	graph             *graph.TreeGraph
+	synced            bool
+}
+
+//Creates a follower of the leader replicating on address, nothing is replicated until Run is
+//called
+func NewFollower(leader string) (*Follower, error) {
+
+	g, err := graph.NewGraph()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Follower{
+		leader:            leader,
+		retryInterval:     DEFAULT_RETRY_INTERVAL,
+		heartbeatInterval: DEFAULT_HEARTBEAT_INTERVAL,
+		graph:             g,
+	}, nil
+}
+
+//Sets the address clients should send INDEX and REMOVE to, the port the leader serves clients
+//on rather than the one it replicates on, call it before the follower is served. Read only
+//errors name no address until it is set.
+func (f *Follower) SetLeaderAddress(address string) {
+	f.leaderAddress = address
+}
+
+//Replicates the leader until ctx is done, reconnecting and catching up from a new snapshot
+//whenever the connection is lost
+func (f *Follower) Run(ctx context.Context) error {
+
+	for {
+		err := f.follow(ctx)
+		f.setSynced(false)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		logger.Printf("Replication from %v stopped:%v retrying in %v\n", f.leader, err, f.retryInterval)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(f.retryInterval):
+		}
+	}
+}
+
+//Reports whether the follower has a snapshot from the leader and is still connected to it
+func (f *Follower) Synced() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.synced
+}
+
+func (f *Follower) setSynced(synced bool) {
+	f.mu.Lock()
+	f.synced = synced
+	f.mu.Unlock()
+}
+
+//Applies the leader's stream until the connection fails. A snapshot is built in a graph of
+//its own and only replaces the served one once complete.
+func (f *Follower) follow(ctx context.Context) error {
+
+	conn, err := (&net.Dialer{Timeout: f.retryInterval}).DialContext(ctx, "tcp", f.leader)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+
+	var pending *graph.TreeGraph
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * f.heartbeatInterval))
+
+		var c change
+		err = decoder.Decode(&c)
+		if err != nil {
+			return err
+		}
+
+		switch c.Op {
+		case opPing:
+		case opSnapshot:
+			pending, err = graph.NewGraph()
+		case opSynced:
+			if pending == nil {
+				return fmt.Errorf("Received %v without a snapshot", c.Op)
+			}
+
+			f.mu.Lock()
+			f.graph = pending
+			f.synced = true
+			f.mu.Unlock()
+
+			logger.Printf("Replicated %d packages from %v\n", pending.Len(), f.leader)
+			pending = nil
+		case opAdd, opRemove:
+			if pending != nil {
+				err = apply(pending, c)
+			} else {
+				f.mu.Lock()
+				err = apply(f.graph, c)
+				f.mu.Unlock()
+			}
+		default:
+			err = fmt.Errorf("Unknown replication op:%v", c.Op)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func apply(g *graph.TreeGraph, c change) error {
+	if c.Op == opRemove {
+		return g.Remove(c.Name)
+	}
+	return g.Add(c.Name, c.Edges...)
+}
+
+func (f *Follower) Add(name string, edges ...string) error {
+	return &repomanager.ReadOnlyError{Leader: f.leaderAddress}
+}
+
+func (f *Follower) Remove(name string) error {
+	return &repomanager.ReadOnlyError{Leader: f.leaderAddress}
+}
+
+func (f *Follower) Exists(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.graph.Exists(name)
+}
+
+func (f *Follower) Dependencies(name string) ([]string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.graph.Dependencies(name)
+}
+
+func (f *Follower) Dependents(name string) ([]string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.graph.Dependents(name)
+}
+
+func (f *Follower) TransitiveDependents(name string) ([]string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.graph.TransitiveDependents(name)
+}
+
+func (f *Follower) Order(name string) ([]string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.graph.Order(name)
+}
+
+func (f *Follower) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.graph.Len()
+}
+
+func (f *Follower) EdgeCount() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.graph.EdgeCount()
+}
+
+func (f *Follower) Versions(name string) []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.graph.Versions(name)
+}
+
+func (f *Follower) Walk(fn func(name string, edges []string) error) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.graph.Walk(fn)
+}
@@ -0,0 +1,268 @@
+package replication
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/jrxfive/packagetree/pkg/repomanager"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+//Backend that streams every successful Add/Remove made to the wrapped backend to its
+//followers. It is a server.ConnectionHandler, every connection it handles is a follower that
+//first receives a snapshot of the packages and then each change as it is committed.
+//Followers that fall DEFAULT_BUFFER_SIZE changes behind are disconnected and catch up from a
+//new snapshot once they reconnect. Changes made by a transaction are held back until it
+//commits, see Batch.
+type Leader struct {
+	Backend
+	mu                sync.Mutex
+	batchMu           sync.Mutex
+	batching          bool
+	batched           []change
+	followers         map[*subscriber]struct{}
+	bufferSize        int
+	heartbeatInterval time.Duration
+	writeTimeout      time.Duration
+}
+
+//Changes waiting to be sent to a single follower, dropped is closed when it falls behind
+type subscriber struct {
+	changes chan change
+	dropped chan struct{}
+}
+
+func NewLeader(backend Backend) *Leader {
+	return &Leader{
+		Backend:           backend,
+		followers:         make(map[*subscriber]struct{}),
+		bufferSize:        DEFAULT_BUFFER_SIZE,
+		heartbeatInterval: DEFAULT_HEARTBEAT_INTERVAL,
+		writeTimeout:      DEFAULT_WRITE_TIMEOUT,
+	}
+}
+
+//Adds name to the wrapped backend and sends the change to every follower. Followers are sent
+//the names the dependencies resolved to rather than the specs, a spec such as libfoo>=1.2 may
+//resolve differently against a follower's packages.
+func (l *Leader) Add(name string, edges ...string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.Backend.Add(name, edges...)
+	if err != nil {
+		return err
+	}
+
+	if resolved, err := l.Backend.Dependencies(name); err == nil && len(edges) > 0 {
+		edges = resolved
+	}
+
+	l.publishOrBatch(change{Op: opAdd, Name: name, Edges: edges})
+	return nil
+}
+
+//Removes name from the wrapped backend and sends the change to every follower, removing an
+//unknown name is not sent
+func (l *Leader) Remove(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.Backend.Exists(name) {
+		return nil
+	}
+
+	err := l.Backend.Remove(name)
+	if err != nil {
+		return err
+	}
+
+	l.publishOrBatch(change{Op: opRemove, Name: name})
+	return nil
+}
+
+//Holds back every change until Flush, so the partial applies and undo steps of a transaction
+//that fails are never sent. Snapshots wait for the batch to end. The wrapped backend is told
+//about the batch when it is a repomanager.Batcher.
+func (l *Leader) Batch() {
+	l.batchMu.Lock()
+
+	l.mu.Lock()
+	l.batching = true
+	if batcher, ok := l.Backend.(repomanager.Batcher); ok {
+		batcher.Batch()
+	}
+	l.mu.Unlock()
+}
+
+//Sends the changes held back since Batch when committed and the wrapped backend kept them,
+//discards them otherwise
+func (l *Leader) Flush(committed bool) error {
+	l.mu.Lock()
+	var err error
+	if batcher, ok := l.Backend.(repomanager.Batcher); ok {
+		err = batcher.Flush(committed)
+	}
+	if committed && err == nil {
+		for _, c := range l.batched {
+			l.publish(c)
+		}
+	}
+	l.batched = nil
+	l.batching = false
+	l.mu.Unlock()
+
+	l.batchMu.Unlock()
+	return err
+}
+
+//Reports the size and versions of the wrapped backend, nothing when it can't
+func (l *Leader) Len() int {
+	if sizer, ok := l.Backend.(repomanager.Sizer); ok {
+		return sizer.Len()
+	}
+	return 0
+}
+
+func (l *Leader) EdgeCount() int {
+	if sizer, ok := l.Backend.(repomanager.Sizer); ok {
+		return sizer.EdgeCount()
+	}
+	return 0
+}
+
+func (l *Leader) Versions(name string) []string {
+	if versioner, ok := l.Backend.(repomanager.Versioner); ok {
+		return versioner.Versions(name)
+	}
+	return nil
+}
+
+//Publishes c or holds it back while batching, must be called holding l.mu
+func (l *Leader) publishOrBatch(c change) {
+	if l.batching {
+		l.batched = append(l.batched, c)
+		return
+	}
+	l.publish(c)
+}
+
+//Queues c for every follower, must be called holding l.mu
+func (l *Leader) publish(c change) {
+	for s := range l.followers {
+		select {
+		case s.changes <- c:
+		default:
+			delete(l.followers, s)
+			close(s.dropped)
+		}
+	}
+}
+
+//Takes a snapshot of the backend and subscribes to every change made after it
+func (l *Leader) subscribe() ([]change, *subscriber, error) {
+	l.batchMu.Lock()
+	defer l.batchMu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	snapshot := []change{{Op: opSnapshot}}
+	err := l.Backend.Walk(func(name string, edges []string) error {
+		snapshot = append(snapshot, change{Op: opAdd, Name: name, Edges: edges})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshot = append(snapshot, change{Op: opSynced})
+
+	s := &subscriber{
+		changes: make(chan change, l.bufferSize),
+		dropped: make(chan struct{}),
+	}
+	l.followers[s] = struct{}{}
+
+	return snapshot, s, nil
+}
+
+func (l *Leader) unsubscribe(s *subscriber) {
+	l.mu.Lock()
+	delete(l.followers, s)
+	l.mu.Unlock()
+}
+
+//Streams the snapshot and every following change to the follower on conn until it
+//disconnects, falls behind or the connection is drained
+func (l *Leader) Handle(conn net.Conn) {
+
+	defer conn.Close()
+
+	snapshot, s, err := l.subscribe()
+	if err != nil {
+		logger.Printf("Failed to snapshot packages for follower %v:%v\n", conn.RemoteAddr(), err)
+		return
+	}
+	defer l.unsubscribe(s)
+
+	logger.Printf("Follower %v connected sending %d packages\n", conn.RemoteAddr(), len(snapshot)-2)
+
+	//Followers never send anything, reading only notices them going away or the server draining
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+
+	writer := bufio.NewWriter(conn)
+	encoder := json.NewEncoder(writer)
+
+	send := func(changes ...change) error {
+		conn.SetWriteDeadline(time.Now().Add(l.writeTimeout))
+		for _, c := range changes {
+			err := encoder.Encode(c)
+			if err != nil {
+				return err
+			}
+		}
+		return writer.Flush()
+	}
+
+	err = send(snapshot...)
+	if err != nil {
+		logger.Printf("Failed to send snapshot to follower %v:%v\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	heartbeat := time.NewTicker(l.heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		var pending []change
+
+		select {
+		case c := <-s.changes:
+			pending = append(pending, c)
+			for len(s.changes) > 0 {
+				pending = append(pending, <-s.changes)
+			}
+		case <-heartbeat.C:
+			pending = append(pending, change{Op: opPing})
+		case <-s.dropped:
+			logger.Printf("Follower %v fell more than %d changes behind disconnecting\n", conn.RemoteAddr(), l.bufferSize)
+			return
+		case <-closed:
+			logger.Printf("Follower %v disconnected\n", conn.RemoteAddr())
+			return
+		}
+
+		err = send(pending...)
+		if err != nil {
+			logger.Printf("Failed to send changes to follower %v:%v\n", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
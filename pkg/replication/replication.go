@@ -0,0 +1,39 @@
+package replication
+
+import (
+	"github.com/jrxfive/packagetree/pkg/logging"
+	"github.com/jrxfive/packagetree/pkg/repomanager"
+	"time"
+)
+
+const (
+	DEFAULT_HEARTBEAT_INTERVAL time.Duration = 5 * time.Second
+	DEFAULT_WRITE_TIMEOUT      time.Duration = 10 * time.Second
+	DEFAULT_RETRY_INTERVAL     time.Duration = time.Second
+	DEFAULT_BUFFER_SIZE        int           = 1024
+
+	opSnapshot = "SNAPSHOT"
+	opSynced   = "SYNCED"
+	opAdd      = "ADD"
+	opRemove   = "REMOVE"
+	opPing     = "PING"
+)
+
+var logger = logging.GetLogger()
+
+//Backend a leader can replicate, it must be able to walk its packages in dependency order to
+//send a snapshot. graph.TreeGraph and storage.DiskBackend both qualify.
+type Backend interface {
+	repomanager.Backend
+	Walk(fn func(name string, edges []string) error) error
+}
+
+//Single message sent from the leader to its followers, one JSON document per line. A follower
+//receives SNAPSHOT, an ADD for every package in dependency order and SYNCED, followed by an
+//ADD or REMOVE for every change committed afterwards. PING is sent when there is nothing else
+//to say so followers can tell a quiet leader from a lost one.
+type change struct {
+	Op    string   `json:"op"`
+	Name  string   `json:"name,omitempty"`
+	Edges []string `json:"edges,omitempty"`
+}
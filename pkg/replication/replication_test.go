@@ -0,0 +1,237 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/jrxfive/packagetree/pkg/graph"
+	"github.com/jrxfive/packagetree/pkg/repomanager"
+	"github.com/jrxfive/packagetree/pkg/server"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//Serves leader on a free port returning the server
+func serveLeader(leader *Leader, t *testing.T) *server.Server {
+	configuration := server.NewServerConfiguration(leader, 0, 10)
+	configuration.DrainNotice = ""
+
+	s, err := server.NewServer(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(context.Background())
+
+	return s
+}
+
+//Starts a follower of addr returning it with the function stopping it
+func startFollower(addr string, t *testing.T) (*Follower, context.CancelFunc) {
+	f, err := NewFollower(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.retryInterval = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go f.Run(ctx)
+
+	return f, cancel
+}
+
+//Polls condition until it holds or a few seconds have passed
+func eventually(condition func() bool) bool {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+func TestReplication(t *testing.T) {
+
+	g, _ := graph.NewGraph()
+	leader := NewLeader(g)
+
+	//Indexed before the follower connects so they arrive through the snapshot
+	leader.Add("gmp")
+	leader.Add("isl", "gmp")
+
+	s := serveLeader(leader, t)
+	defer s.Shutdown(context.Background())
+
+	f, cancel := startFollower(s.Addr().String(), t)
+	defer cancel()
+
+	if !eventually(f.Synced) {
+		t.Fatal("Follower did not sync with the leader")
+	}
+
+	leader.Add("cloog", "gmp", "isl")
+	leader.Remove("isl")
+	leader.Add("isl")
+	leader.Remove("unknown")
+
+	var tests = []struct {
+		name         string
+		exists       bool
+		dependencies []string
+	}{
+		{"gmp", true, []string{}},
+		{"isl", true, []string{}},
+		{"cloog", true, []string{"gmp", "isl"}},
+		{"unknown", false, nil},
+	}
+
+	if !eventually(func() bool { return f.Exists("cloog") && f.Exists("isl") }) {
+		t.Fatal("Follower did not apply the changes made after the snapshot")
+	}
+
+	for _, test := range tests {
+		if f.Exists(test.name) != test.exists {
+			t.Errorf("Exists(%s) expected:%v", test.name, test.exists)
+		}
+
+		if !test.exists {
+			continue
+		}
+
+		dependencies, err := f.Dependencies(test.name)
+		if err != nil || !reflect.DeepEqual(dependencies, test.dependencies) {
+			t.Errorf("Dependencies(%s) = %v %v, expected:%v", test.name, dependencies, err, test.dependencies)
+		}
+	}
+
+	if f.Len() != 3 || f.EdgeCount() != 2 {
+		t.Errorf("Follower size = %d/%d, expected:3/2", f.Len(), f.EdgeCount())
+	}
+}
+
+func TestLeaderTransaction(t *testing.T) {
+
+	g, _ := graph.NewGraph()
+	leader := NewLeader(g)
+	repo := repomanager.NewRepo(leader)
+
+	_, s, err := leader.subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name     string
+		commands []string
+		expected []change
+	}{
+		{"failed commit", []string{"BEGIN||", "INDEX|a|", "INDEX|b|missing", "COMMIT||"}, nil},
+		{"commit", []string{"BEGIN||", "INDEX|cloog|gmp", "INDEX|gmp|", "REMOVE|unknown|", "COMMIT||"}, []change{
+			{Op: opAdd, Name: "gmp"},
+			{Op: opAdd, Name: "cloog", Edges: []string{"gmp"}},
+		}},
+		{"resolved dependencies", []string{"BEGIN||", "INDEX|libfoo@1.2|", "INDEX|app|libfoo>=1,<2", "COMMIT||"}, []change{
+			{Op: opAdd, Name: "libfoo@1.2"},
+			{Op: opAdd, Name: "app", Edges: []string{"libfoo@1.2"}},
+		}},
+	}
+
+	for _, test := range tests {
+		client, conn := net.Pipe()
+		go repo.Handle(conn)
+
+		client.SetDeadline(time.Now().Add(3 * time.Second))
+		reader := bufio.NewReader(client)
+		for _, command := range test.commands {
+			fmt.Fprintln(client, command)
+			if _, err := reader.ReadString('\n'); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		client.Close()
+
+		var published []change
+		for len(s.changes) > 0 {
+			published = append(published, <-s.changes)
+		}
+
+		if len(published) != len(test.expected) || (len(published) > 0 && !reflect.DeepEqual(published, test.expected)) {
+			t.Errorf("%s: Published:%v, expected:%v", test.name, published, test.expected)
+		}
+	}
+}
+
+func TestFollowerReadOnly(t *testing.T) {
+
+	var tests = []struct {
+		leaderAddress string
+		expected      string
+	}{
+		{"", ""},
+		{"leader:8080", "leader:8080"},
+	}
+
+	for _, test := range tests {
+		f, err := NewFollower("leader:9000")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.leaderAddress != "" {
+			f.SetLeaderAddress(test.leaderAddress)
+		}
+
+		for _, err := range []error{f.Add("gmp"), f.Remove("gmp")} {
+			readOnly, ok := err.(*repomanager.ReadOnlyError)
+			if !ok || readOnly.Leader != test.expected {
+				t.Errorf("Expected ReadOnlyError for %q Got:%v", test.expected, err)
+			}
+		}
+	}
+}
+
+func TestFollowerCatchUp(t *testing.T) {
+
+	g, _ := graph.NewGraph()
+	leader := NewLeader(g)
+	leader.bufferSize = 1
+	leader.Add("gmp")
+
+	s := serveLeader(leader, t)
+	defer s.Shutdown(context.Background())
+
+	f, cancel := startFollower(s.Addr().String(), t)
+	defer cancel()
+
+	if !eventually(f.Synced) {
+		t.Fatal("Follower did not sync with the leader")
+	}
+
+	//More changes than the follower's buffer holds at once, followers that fall behind are
+	//disconnected and catch up from a new snapshot
+	leader.mu.Lock()
+	for _, name := range []string{"isl", "ppl", "cloog"} {
+		g.Add(name, "gmp")
+		leader.publish(change{Op: opAdd, Name: name, Edges: []string{"gmp"}})
+	}
+	leader.mu.Unlock()
+
+	if !eventually(func() bool { return f.Len() == 4 && f.Synced() }) {
+		t.Errorf("Follower has %d packages, expected it to catch up to 4", f.Len())
+	}
+}
+
+func TestFollowerServedThroughRepo(t *testing.T) {
+
+	f, err := NewFollower("leader:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := repomanager.NewRepo(f)
+	if packages, _, ok := repo.Size(); !ok || packages != 0 {
+		t.Errorf("Size() = %d %v, expected an empty replica", packages, ok)
+	}
+}
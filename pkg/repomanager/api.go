@@ -0,0 +1,251 @@
+package repomanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jrxfive/packagetree/pkg/graph"
+	"strings"
+)
+
+//Returned by Dependencies, Dependents and Order for packages that aren't indexed
+var ErrNotIndexed = errors.New("Package is not indexed")
+
+//Returned by List when the backend doesn't implement Walker, and by Walk on the backend
+//operations are given
+var ErrListUnsupported = errors.New("Backend can't list its packages")
+
+//Returned by the Repo API for arguments the protocol would answer with ERROR, e.g. an
+//invalid package name
+type RequestError struct {
+	Command string
+	Err     error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("Invalid %s request:%v", e.Command, e.Err)
+}
+
+//Indexes name with its dependencies, the same as INDEX|name|dependencies. Every method of
+//the Repo API is safe to call from several goroutines and returns a *RequestError for
+//invalid arguments or ctx's error when the lock isn't acquired before ctx is done or the
+//lock timeout passes. Index and Remove return the backend's error otherwise, e.g. a
+//*graph.MissingDependenciesError, a *graph.DependentsExistError or a *ReadOnlyError.
+func (r *Repo) Index(ctx context.Context, name string, dependencies ...string) error {
+
+	err := validateRequest(INDEX, name, dependencies)
+	if err != nil {
+		return err
+	}
+
+	return r.Update(ctx, func(backend Backend) error {
+		return r.index(backend, name, dependencies)
+	})
+}
+
+//Removes name, the same as REMOVE|name|. Removing a package that isn't indexed succeeds, a
+//bare name only versions of are indexed fails with an *AmbiguousNameError.
+func (r *Repo) Remove(ctx context.Context, name string) error {
+
+	err := validateRequest(REMOVE, name, nil)
+	if err != nil {
+		return err
+	}
+
+	return r.Update(ctx, func(backend Backend) error {
+		return r.remove(backend, name)
+	})
+}
+
+//Reports whether name is indexed, the same as QUERY|name|
+func (r *Repo) Query(ctx context.Context, name string) (bool, error) {
+
+	err := validateRequest(QUERY, name, nil)
+	if err != nil {
+		return false, err
+	}
+
+	var exists bool
+	err = r.View(ctx, func(backend Backend) error {
+		exists = query(backend, name)
+		return nil
+	})
+
+	return exists, err
+}
+
+//Returns the dependencies name was indexed with, the same as DEPS|name|
+func (r *Repo) Dependencies(ctx context.Context, name string) ([]string, error) {
+	return r.lookup(ctx, DEPS, name, nil, func(backend Backend) ([]string, error) {
+		return backend.Dependencies(name)
+	})
+}
+
+//Returns the packages depending on name, or every package depending on it directly or
+//indirectly when transitive is set, the same as RDEPS|name| and RDEPS|name|transitive
+func (r *Repo) Dependents(ctx context.Context, name string, transitive bool) ([]string, error) {
+
+	var options []string
+	if transitive {
+		options = []string{TRANSITIVE}
+	}
+
+	return r.lookup(ctx, RDEPS, name, options, func(backend Backend) ([]string, error) {
+		return dependents(backend, name, transitive)
+	})
+}
+
+//Returns name and its transitive dependencies in install order, the same as ORDER|name|
+func (r *Repo) Order(ctx context.Context, name string) ([]string, error) {
+	return r.lookup(ctx, ORDER, name, nil, func(backend Backend) ([]string, error) {
+		return backend.Order(name)
+	})
+}
+
+//Returns every indexed package in an order they can be installed in, the same as LIST||
+func (r *Repo) List(ctx context.Context) ([]string, error) {
+
+	var packages []string
+	err := r.View(ctx, func(backend Backend) error {
+		var err error
+		packages, err = list(backend)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return packages, nil
+}
+
+//Validates and runs a read only lookup of name, backend errors for packages that aren't
+//indexed are reported as ErrNotIndexed
+func (r *Repo) lookup(ctx context.Context, command, name string, options []string, fn func(backend Backend) ([]string, error)) ([]string, error) {
+
+	err := validateRequest(command, name, options)
+	if err != nil {
+		return nil, err
+	}
+
+	var packages []string
+	err = r.View(ctx, func(backend Backend) error {
+		var err error
+		packages, err = fn(backend)
+		if err != nil && !backend.Exists(name) {
+			return ErrNotIndexed
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return packages, nil
+}
+
+//Checks the arguments of command against the rules it was registered with
+func validateRequest(command, name string, dependencies []string) error {
+
+	c, exists := lookupCommand(command)
+	if !exists {
+		return &RequestError{Command: command, Err: errors.New("Unknown command")}
+	}
+
+	request := &Request{
+		Command:      command,
+		Package:      name,
+		Dependencies: dependencies,
+	}
+	for _, rule := range c.rules {
+		err := rule(request)
+		if err != nil {
+			return &RequestError{Command: command, Err: err}
+		}
+	}
+
+	return nil
+}
+
+//The functions below are shared by the Repo API and the protocol's operators, callers hold
+//the lock the operation needs
+
+//Adds name to backend and tells watchers about it
+func (r *Repo) index(backend Backend, name string, dependencies []string) error {
+
+	err := backend.Add(name, dependencies...)
+	if err != nil {
+		return err
+	}
+
+	r.watchers.publish(&instruction{cmd: INDEX, packageName: name, packageDependencies: dependencies})
+	return nil
+}
+
+//Removes name from backend and tells watchers about it when it was indexed
+func (r *Repo) remove(backend Backend, name string) error {
+
+	err := checkRemove(backend, name)
+	if err != nil {
+		return err
+	}
+
+	existed := backend.Exists(name)
+	err = backend.Remove(name)
+	if err != nil {
+		return err
+	}
+
+	if existed {
+		r.watchers.publish(&instruction{cmd: REMOVE, packageName: name})
+	}
+	return nil
+}
+
+//A bare name such as openssl is also indexed when any version of it is, name@version only
+//when that version is
+func query(backend Backend, name string) bool {
+
+	exists := backend.Exists(name)
+	if !exists && !strings.Contains(name, graph.VERSION_SEPARATOR) {
+		if versioner, ok := backend.(Versioner); ok {
+			exists = len(versioner.Versions(name)) > 0
+		}
+	}
+
+	return exists
+}
+
+//Fails for a bare name query reports as indexed because versions of it are, removing it
+//would change nothing
+func checkRemove(backend Backend, name string) error {
+
+	if backend.Exists(name) || !query(backend, name) {
+		return nil
+	}
+
+	versioner, _ := backend.(Versioner)
+	return &AmbiguousNameError{Name: name, Versions: versioner.Versions(name)}
+}
+
+func list(backend Backend) ([]string, error) {
+
+	walker, ok := backend.(Walker)
+	if !ok {
+		return nil, ErrListUnsupported
+	}
+
+	packages := []string{}
+	err := walker.Walk(func(name string, edges []string) error {
+		packages = append(packages, name)
+		return nil
+	})
+
+	return packages, err
+}
+
+func dependents(backend Backend, name string, transitive bool) ([]string, error) {
+	if transitive {
+		return backend.TransitiveDependents(name)
+	}
+	return backend.Dependents(name)
+}
@@ -0,0 +1,121 @@
+package repomanager
+
+import (
+	"encoding/json"
+	"net"
+)
+
+//Command decoded from a single message. ID is chosen by the client and echoed in the
+//response by codecs that support it
+type Request struct {
+	ID           string   `json:"id,omitempty"`
+	Command      string   `json:"command"`
+	Package      string   `json:"package"`
+	Dependencies []string `json:"dependencies,omitempty"`
+}
+
+//Turns the \n framed messages read from a connection into requests and responses back into
+//bytes. output is the protocol response, e.g. OK, FAIL|HAS_DEPENDENTS|cloog or a WATCH event
+//such as INDEXED|cloog|gmp. request is nil when the message could not be decoded.
+type Codec interface {
+	Decode(message []byte) (*Request, error)
+	Encode(request *Request, output string) []byte
+}
+
+//Default codec for the cmd|pkg|deps format, responses are sent as they are followed by \n
+type PipeCodec struct {
+}
+
+func (c PipeCodec) Decode(message []byte) (*Request, error) {
+
+	i, err := createInstructionSet(message)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Request{
+		Command:      i.cmd,
+		Package:      i.packageName,
+		Dependencies: i.packageDependencies,
+	}, nil
+}
+
+func (c PipeCodec) Encode(request *Request, output string) []byte {
+	return []byte(output + "\n")
+}
+
+//Codec for newline delimited JSON. Requests look like
+//
+//	{"id":"7","command":"INDEX","package":"cloog","dependencies":["gmp","isl>=0.20"]}
+//
+//and are answered with the same JSON body as the HTTP API plus the request's id
+//
+//	{"id":"7","name":"cloog","status":"FAIL"}
+//
+//Like the pipe protocol a FAIL only carries its reason and packages once the session has
+//sent VERBOSE with package on
+//
+//	{"id":"8","name":"cloog","status":"FAIL","reason":"MISSING_DEPENDENCIES","packages":["gmp"]}
+//
+//Each dependency is a single spec so constraints need no special handling of commas.
+type JSONCodec struct {
+}
+
+type jsonResponse struct {
+	ID string `json:"id,omitempty"`
+	*httpResponse
+}
+
+func (c JSONCodec) Decode(message []byte) (*Request, error) {
+
+	var request Request
+	err := json.Unmarshal(message, &request)
+	if err != nil {
+		return nil, err
+	}
+
+	return &request, nil
+}
+
+func (c JSONCodec) Encode(request *Request, output string) []byte {
+
+	response := jsonResponse{}
+	if request != nil {
+		response.ID = request.ID
+		response.httpResponse = parseResponse(request.Package, output)
+	} else {
+		response.httpResponse = parseResponse("", output)
+	}
+
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		return []byte(ERROR + "\n")
+	}
+
+	return append(encoded, '\n')
+}
+
+//Serves the repo's TCP protocol with a codec other than the default, one per listener
+type CodecHandler struct {
+	repo  *Repo
+	codec Codec
+}
+
+func NewCodecHandler(repo *Repo, codec Codec) *CodecHandler {
+	return &CodecHandler{
+		repo:  repo,
+		codec: codec,
+	}
+}
+
+func (h *CodecHandler) Handle(conn net.Conn) {
+	h.repo.handle(conn, h.codec)
+}
+
+func (r *Request) instruction() *instruction {
+	return &instruction{
+		cmd:                 r.Command,
+		packageName:         r.Package,
+		packageDependencies: r.Dependencies,
+	}
+}
@@ -0,0 +1,44 @@
+package repomanager
+
+import "strings"
+
+const DEPS string = "DEPS"
+
+func init() {
+	mustRegister(DEPS, func(instruction *instruction, repo *Repo, session *session) Operation {
+		return NewDepsOperator(instruction, repo)
+	}, ValidPackage, ValidDependencies)
+}
+
+type DepsOperator struct {
+	instruction *instruction
+	repo        *Repo
+}
+
+func NewDepsOperator(instruction *instruction, repo *Repo) *DepsOperator {
+	return &DepsOperator{
+		instruction: instruction,
+		repo:        repo,
+	}
+}
+
+//Returns OK followed by the comma delimited dependencies the package was indexed with,
+//e.g. OK|gmp,isl,pkg-config, or FAIL when the package is not indexed
+func (o DepsOperator) Run(backend Backend) (string, error) {
+
+	dependencies, err := backend.Dependencies(o.instruction.packageName)
+
+	if err != nil {
+		return FAIL, nil
+	}
+	return OK + "|" + strings.Join(dependencies, ","), nil
+
+}
+
+func (o DepsOperator) Access() Access {
+	return ACCESS_READ
+}
+
+func (o DepsOperator) GetCommand() string {
+	return o.instruction.cmd
+}
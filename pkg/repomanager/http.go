@@ -0,0 +1,140 @@
+package repomanager
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const PACKAGES_PATH string = "/packages/"
+
+//JSON body accepted by PUT /packages/{name}
+type httpIndexRequest struct {
+	Dependencies []string `json:"dependencies"`
+}
+
+//JSON body returned by every endpoint. Status is the protocol response code, FAIL carries
+//the reason code and the packages involved, OK carries the packages a listing returned
+type httpResponse struct {
+	Name     string   `json:"name"`
+	Status   string   `json:"status"`
+	Reason   string   `json:"reason,omitempty"`
+	Packages []string `json:"packages,omitempty"`
+}
+
+//Serves the repo over HTTP, every request is turned into an instruction and run through
+//the same operators as the TCP protocol so both share validation and locking. Requests that
+//give up waiting for the lock are answered 503 Service Unavailable with status ERROR.
+//
+//	GET    /packages/{name}             QUERY
+//	PUT    /packages/{name}             INDEX, body {"dependencies":["gmp","isl"]}
+//	DELETE /packages/{name}             REMOVE
+//	GET    /packages/{name}/deps        DEPS
+//	GET    /packages/{name}/dependents  RDEPS, ?transitive=true for every dependent
+//	GET    /packages/{name}/order       ORDER
+type HTTPHandler struct {
+	repo *Repo
+}
+
+func NewHTTPHandler(repo *Repo) *HTTPHandler {
+	return &HTTPHandler{
+		repo: repo,
+	}
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	if !strings.HasPrefix(req.URL.Path, PACKAGES_PATH) {
+		http.NotFound(w, req)
+		return
+	}
+
+	segments := strings.Split(strings.TrimPrefix(req.URL.Path, PACKAGES_PATH), "/")
+	name := segments[0]
+
+	var i *instruction
+	switch {
+	case len(segments) == 1 && req.Method == http.MethodGet:
+		i = &instruction{cmd: QUERY, packageName: name}
+	case len(segments) == 1 && req.Method == http.MethodPut:
+		var body httpIndexRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, req.Body, MAX_MESSAGE_LENGTH)).Decode(&body)
+		if err != nil && err != io.EOF {
+			writeHTTPResponse(w, http.StatusBadRequest, &httpResponse{Name: name, Status: ERROR})
+			return
+		}
+		i = &instruction{cmd: INDEX, packageName: name, packageDependencies: body.Dependencies}
+	case len(segments) == 1 && req.Method == http.MethodDelete:
+		i = &instruction{cmd: REMOVE, packageName: name}
+	case len(segments) == 2 && segments[1] == "deps" && req.Method == http.MethodGet:
+		i = &instruction{cmd: DEPS, packageName: name}
+	case len(segments) == 2 && segments[1] == "dependents" && req.Method == http.MethodGet:
+		i = &instruction{cmd: RDEPS, packageName: name}
+		if req.URL.Query().Get(TRANSITIVE) == "true" {
+			i.packageDependencies = []string{TRANSITIVE}
+		}
+	case len(segments) == 2 && segments[1] == "order" && req.Method == http.MethodGet:
+		i = &instruction{cmd: ORDER, packageName: name}
+	case len(segments) <= 2:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	session := newSession()
+	session.verbose = true
+
+	output, err := h.repo.runOperator(req.Context(), validateAndCreateOperator(i, h.repo, session), session)
+	response := parseResponse(name, output)
+
+	switch {
+	case err == errLockTimeout:
+		writeHTTPResponse(w, http.StatusServiceUnavailable, response)
+	case response.Status == OK:
+		writeHTTPResponse(w, http.StatusOK, response)
+	case response.Status == FAIL && (i.cmd == INDEX || i.cmd == REMOVE):
+		writeHTTPResponse(w, http.StatusConflict, response)
+	case response.Status == FAIL:
+		writeHTTPResponse(w, http.StatusNotFound, response)
+	default:
+		writeHTTPResponse(w, http.StatusBadRequest, response)
+	}
+}
+
+//Splits a protocol response such as OK|gmp,isl or FAIL|HAS_DEPENDENTS|cloog. WATCH events
+//such as INDEXED|cloog|gmp,isl name the package they are about
+func parseResponse(name, output string) *httpResponse {
+
+	fields := strings.Split(output, "|")
+	response := &httpResponse{
+		Name:   name,
+		Status: fields[0],
+	}
+
+	packages := ""
+	switch {
+	case len(fields) == 3 && (fields[0] == INDEXED || fields[0] == REMOVED):
+		response.Name = fields[1]
+		packages = fields[2]
+	case len(fields) == 2:
+		packages = fields[1]
+	case len(fields) == 3:
+		response.Reason = fields[1]
+		packages = fields[2]
+	}
+
+	if packages != "" {
+		response.Packages = getDependencyPackages([]byte(packages))
+	}
+
+	return response
+}
+
+func writeHTTPResponse(w http.ResponseWriter, status int, response *httpResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
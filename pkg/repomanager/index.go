@@ -2,6 +2,15 @@ package repomanager
 
 const INDEX string = "INDEX"
 
+func init() {
+	mustRegister(INDEX, func(instruction *instruction, repo *Repo, session *session) Operation {
+		if session.transaction != nil {
+			return NewQueueOperator(instruction, session)
+		}
+		return NewIndexOperator(instruction, repo)
+	}, ValidPackage, ValidDependencies)
+}
+
 type IndexOperator struct {
 	instruction *instruction
 	repo        *Repo
@@ -14,19 +23,21 @@ func NewIndexOperator(instruction *instruction, repo *Repo) *IndexOperator {
 	}
 }
 
-func (o IndexOperator) Run() (string, error) {
+func (o IndexOperator) Run(backend Backend) (string, error) {
 
-	o.repo.mu.Lock()
-	err := o.repo.backend.Add(o.instruction.packageName, o.instruction.packageDependencies...)
-	o.repo.mu.Unlock()
+	err := o.repo.index(backend, o.instruction.packageName, o.instruction.packageDependencies)
 
 	if err != nil {
-		return FAIL, nil
+		return FAIL, err
 	}
 	return OK, nil
 
 }
 
+func (o IndexOperator) Access() Access {
+	return ACCESS_WRITE
+}
+
 func (o IndexOperator) GetCommand() string {
 	return o.instruction.cmd
 }
@@ -0,0 +1,195 @@
+package repomanager
+
+import (
+	"context"
+	"github.com/jrxfive/packagetree/pkg/metrics"
+	"strings"
+	"time"
+)
+
+const (
+	readLock  string = "read"
+	writeLock string = "write"
+)
+
+var commandsTotal = metrics.NewCounterVec("packagetree_commands_total", "Commands handled by command and response code.", "command", "code")
+var connectionTimeoutsTotal = metrics.NewCounterVec("packagetree_connection_timeouts_total", "Connections closed because the client stopped sending.")
+var lockWaitSeconds = metrics.NewHistogramVec("packagetree_lock_wait_seconds", "Time spent waiting for the repo lock.", metrics.LatencyBuckets, "mode")
+var lockTimeoutsTotal = metrics.NewCounterVec("packagetree_lock_timeouts_total", "Lock acquisitions given up on because of the lock timeout or cancellation.", "mode")
+var backendSeconds = metrics.NewHistogramVec("packagetree_backend_seconds", "Time spent in backend calls.", metrics.LatencyBuckets, "method")
+
+//Implemented by backends that can report how many packages and dependency edges they hold
+type Sizer interface {
+	Len() int
+	EdgeCount() int
+}
+
+//Implemented by backends that index several versions of a package, Versions returns every
+//indexed name for a bare name such as openssl, e.g. openssl@1.1 and openssl@3
+type Versioner interface {
+	Versions(name string) []string
+}
+
+//Implemented by backends that can list their packages, Walk calls fn for every package after
+//its dependencies
+type Walker interface {
+	Walk(fn func(name string, edges []string) error) error
+}
+
+//Implemented by backends with side effects that must only follow committed changes, such as
+//replicating or logging them. COMMIT calls Batch before applying a transaction and Flush once
+//it is done, committed reports whether its changes were kept or undone. Flush returns an
+//error when committed changes couldn't be kept, the backend is then left as it was at Batch
+//and the transaction fails.
+type Batcher interface {
+	Batch()
+	Flush(committed bool) error
+}
+
+//Returns the number of packages and dependency edges in the backend, ok is false when the
+//backend can't report its size or the read lock wasn't acquired within the lock timeout
+func (r *Repo) Size() (packages int, edges int, ok bool) {
+
+	if r.sizer == nil {
+		return 0, 0, false
+	}
+
+	err := r.rlock(context.Background())
+	if err != nil {
+		return 0, 0, false
+	}
+	packages, edges = r.sizer.Len(), r.sizer.EdgeCount()
+	r.runlock()
+
+	return packages, edges, true
+}
+
+//Acquires the write lock recording how long it waited, gives up once ctx is done or the
+//lock timeout has passed
+func (r *Repo) lock(ctx context.Context) error {
+
+	ctx, cancel := r.lockContext(ctx)
+	defer cancel()
+
+	start := time.Now()
+	err := r.mu.Lock(ctx)
+	r.observeLock(writeLock, start, err)
+
+	return err
+}
+
+func (r *Repo) unlock() {
+	r.mu.Unlock()
+}
+
+//Acquires the read lock recording how long it waited, gives up once ctx is done or the
+//lock timeout has passed
+func (r *Repo) rlock(ctx context.Context) error {
+
+	ctx, cancel := r.lockContext(ctx)
+	defer cancel()
+
+	start := time.Now()
+	err := r.mu.RLock(ctx)
+	r.observeLock(readLock, start, err)
+
+	return err
+}
+
+func (r *Repo) runlock() {
+	r.mu.RUnlock()
+}
+
+func (r *Repo) lockContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if r.lockTimeout > 0 {
+		return context.WithTimeout(parent, r.lockTimeout)
+	}
+	return context.WithCancel(parent)
+}
+
+func (r *Repo) observeLock(mode string, start time.Time, err error) {
+	lockWaitSeconds.Observe(time.Since(start).Seconds(), mode)
+	if err != nil {
+		lockTimeoutsTotal.Inc(mode)
+	}
+}
+
+//Counts a response by the command that produced it and its response code
+func countCommand(command, output string) {
+	commandsTotal.Inc(command, strings.SplitN(output, "|", 2)[0])
+}
+
+func observeBackend(method string, start time.Time) {
+	backendSeconds.Observe(time.Since(start).Seconds(), method)
+}
+
+//Times every call made to the wrapped backend. It implements every optional interface so
+//operations can look them up on the backend they are given, Versions finds nothing and Walk
+//returns ErrListUnsupported when the wrapped backend doesn't implement them.
+type instrumentedBackend struct {
+	backend Backend
+}
+
+func (b instrumentedBackend) Exists(name string) bool {
+	defer observeBackend("Exists", time.Now())
+	return b.backend.Exists(name)
+}
+
+func (b instrumentedBackend) Add(name string, edges ...string) error {
+	defer observeBackend("Add", time.Now())
+	return b.backend.Add(name, edges...)
+}
+
+func (b instrumentedBackend) Remove(name string) error {
+	defer observeBackend("Remove", time.Now())
+	return b.backend.Remove(name)
+}
+
+func (b instrumentedBackend) Dependencies(name string) ([]string, error) {
+	defer observeBackend("Dependencies", time.Now())
+	return b.backend.Dependencies(name)
+}
+
+func (b instrumentedBackend) Dependents(name string) ([]string, error) {
+	defer observeBackend("Dependents", time.Now())
+	return b.backend.Dependents(name)
+}
+
+func (b instrumentedBackend) TransitiveDependents(name string) ([]string, error) {
+	defer observeBackend("TransitiveDependents", time.Now())
+	return b.backend.TransitiveDependents(name)
+}
+
+func (b instrumentedBackend) Order(name string) ([]string, error) {
+	defer observeBackend("Order", time.Now())
+	return b.backend.Order(name)
+}
+
+func (b instrumentedBackend) Versions(name string) []string {
+	defer observeBackend("Versions", time.Now())
+	if versioner, ok := b.backend.(Versioner); ok {
+		return versioner.Versions(name)
+	}
+	return nil
+}
+
+func (b instrumentedBackend) Walk(fn func(name string, edges []string) error) error {
+	defer observeBackend("Walk", time.Now())
+	if walker, ok := b.backend.(Walker); ok {
+		return walker.Walk(fn)
+	}
+	return ErrListUnsupported
+}
+
+func (b instrumentedBackend) Batch() {
+	if batcher, ok := b.backend.(Batcher); ok {
+		batcher.Batch()
+	}
+}
+
+func (b instrumentedBackend) Flush(committed bool) error {
+	if batcher, ok := b.backend.(Batcher); ok {
+		return batcher.Flush(committed)
+	}
+	return nil
+}
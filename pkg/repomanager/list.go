@@ -0,0 +1,42 @@
+package repomanager
+
+import "strings"
+
+const LIST string = "LIST"
+
+func init() {
+	mustRegister(LIST, func(instruction *instruction, repo *Repo, session *session) Operation {
+		return NewListOperator(instruction, repo)
+	}, NoPackage, NoDependencies)
+}
+
+type ListOperator struct {
+	instruction *instruction
+	repo        *Repo
+}
+
+func NewListOperator(instruction *instruction, repo *Repo) *ListOperator {
+	return &ListOperator{
+		instruction: instruction,
+		repo:        repo,
+	}
+}
+
+//Returns OK followed by every indexed package in an order they can be installed in, e.g.
+//OK|gmp,isl,cloog, or FAIL when the backend can't list its packages
+func (o ListOperator) Run(backend Backend) (string, error) {
+
+	packages, err := list(backend)
+	if err != nil {
+		return FAIL, nil
+	}
+	return OK + "|" + strings.Join(packages, ","), nil
+}
+
+func (o ListOperator) Access() Access {
+	return ACCESS_READ
+}
+
+func (o ListOperator) GetCommand() string {
+	return o.instruction.cmd
+}
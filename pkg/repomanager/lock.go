@@ -0,0 +1,98 @@
+package repomanager
+
+import (
+	"context"
+)
+
+//Readers/writer lock whose acquisition gives up once a context is done. A waiting writer
+//holds the turnstile so readers arriving after it wait for it instead of starving it, the
+//way sync.RWMutex does.
+type rwLock struct {
+	turnstile chan struct{}
+	exclusive chan struct{}
+	readers   chan int
+}
+
+func newRWLock() *rwLock {
+	l := &rwLock{
+		turnstile: make(chan struct{}, 1),
+		exclusive: make(chan struct{}, 1),
+		readers:   make(chan int, 1),
+	}
+	l.readers <- 0
+
+	return l
+}
+
+//Acquires the lock for writing, returns ctx's error without holding the lock when ctx is
+//done first
+func (l *rwLock) Lock(ctx context.Context) error {
+
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case l.turnstile <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-l.turnstile }()
+
+	select {
+	case l.exclusive <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *rwLock) Unlock() {
+	<-l.exclusive
+}
+
+//Acquires the lock for reading, returns ctx's error without holding the lock when ctx is
+//done first. The first reader in takes the lock for every reader after it.
+func (l *rwLock) RLock(ctx context.Context) error {
+
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case l.turnstile <- struct{}{}:
+		<-l.turnstile
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var readers int
+	select {
+	case readers = <-l.readers:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if readers == 0 {
+		select {
+		case l.exclusive <- struct{}{}:
+		case <-ctx.Done():
+			l.readers <- readers
+			return ctx.Err()
+		}
+	}
+
+	l.readers <- readers + 1
+	return nil
+}
+
+//The last reader out releases the lock
+func (l *rwLock) RUnlock() {
+	readers := <-l.readers
+	if readers == 1 {
+		<-l.exclusive
+	}
+	l.readers <- readers - 1
+}
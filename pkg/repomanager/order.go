@@ -0,0 +1,44 @@
+package repomanager
+
+import "strings"
+
+const ORDER string = "ORDER"
+
+func init() {
+	mustRegister(ORDER, func(instruction *instruction, repo *Repo, session *session) Operation {
+		return NewOrderOperator(instruction, repo)
+	}, ValidPackage, ValidDependencies)
+}
+
+type OrderOperator struct {
+	instruction *instruction
+	repo        *Repo
+}
+
+func NewOrderOperator(instruction *instruction, repo *Repo) *OrderOperator {
+	return &OrderOperator{
+		instruction: instruction,
+		repo:        repo,
+	}
+}
+
+//Returns OK followed by the package and its transitive dependencies in install order,
+//e.g. OK|gmp,isl,pkg-config,cloog, or FAIL when the package is not indexed
+func (o OrderOperator) Run(backend Backend) (string, error) {
+
+	order, err := backend.Order(o.instruction.packageName)
+
+	if err != nil {
+		return FAIL, nil
+	}
+	return OK + "|" + strings.Join(order, ","), nil
+
+}
+
+func (o OrderOperator) Access() Access {
+	return ACCESS_READ
+}
+
+func (o OrderOperator) GetCommand() string {
+	return o.instruction.cmd
+}
@@ -2,6 +2,14 @@ package repomanager
 
 const QUERY string = "QUERY"
 
+func init() {
+	mustRegister(QUERY, func(instruction *instruction, repo *Repo, session *session) Operation {
+		return NewQueryOperator(instruction, repo)
+	}, ValidPackage, ValidDependencies)
+}
+
+//Answers OK when the package is indexed. A bare name such as openssl is also OK when any
+//version of it is indexed, name@version only matches that version
 type QueryOperator struct {
 	instruction *instruction
 	repo        *Repo
@@ -14,19 +22,19 @@ func NewQueryOperator(instruction *instruction, repo *Repo) *QueryOperator {
 	}
 }
 
-func (o QueryOperator) Run() (string, error) {
-
-	o.repo.mu.RLock()
-	exists := o.repo.backend.Exists(o.instruction.packageName)
-	o.repo.mu.RUnlock()
+func (o QueryOperator) Run(backend Backend) (string, error) {
 
-	if exists {
+	if query(backend, o.instruction.packageName) {
 		return OK, nil
 	}
 	return FAIL, nil
 
 }
 
+func (o QueryOperator) Access() Access {
+	return ACCESS_READ
+}
+
 func (o QueryOperator) GetCommand() string {
 	return o.instruction.cmd
 }
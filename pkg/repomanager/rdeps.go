@@ -0,0 +1,60 @@
+package repomanager
+
+import "strings"
+
+const RDEPS string = "RDEPS"
+
+//Option given in place of dependencies to list every package that depends on the package
+//directly or indirectly, e.g. RDEPS|gmp|transitive
+const TRANSITIVE string = "transitive"
+
+func init() {
+	mustRegister(RDEPS, func(instruction *instruction, repo *Repo, session *session) Operation {
+		return NewRdepsOperator(instruction, repo)
+	}, ValidPackage, ValidDependencies, ruleFor(func(request *Request) bool {
+		return validateRdepsOptions(request.Dependencies)
+	}))
+}
+
+type RdepsOperator struct {
+	instruction *instruction
+	repo        *Repo
+}
+
+func NewRdepsOperator(instruction *instruction, repo *Repo) *RdepsOperator {
+	return &RdepsOperator{
+		instruction: instruction,
+		repo:        repo,
+	}
+}
+
+//Returns OK followed by the comma delimited packages that depend on the package, or FAIL
+//when the package is not indexed. Transitive dependents are listed in an order they can be
+//removed in
+func (o RdepsOperator) Run(backend Backend) (string, error) {
+
+	dependents, err := dependents(backend, o.instruction.packageName, o.transitive())
+
+	if err != nil {
+		return FAIL, nil
+	}
+	return OK + "|" + strings.Join(dependents, ","), nil
+
+}
+
+func (o RdepsOperator) Access() Access {
+	return ACCESS_READ
+}
+
+func (o RdepsOperator) GetCommand() string {
+	return o.instruction.cmd
+}
+
+func (o RdepsOperator) transitive() bool {
+	return len(o.instruction.packageDependencies) == 1 && o.instruction.packageDependencies[0] == TRANSITIVE
+}
+
+//Only no option or the transitive option are understood
+func validateRdepsOptions(options []string) bool {
+	return len(options) == 0 || (len(options) == 1 && options[0] == TRANSITIVE)
+}
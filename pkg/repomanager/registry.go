@@ -0,0 +1,141 @@
+package repomanager
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//Checks the arguments of a request before its operation is created, requests failing any
+//rule of their command are answered with ERROR
+type Rule func(request *Request) error
+
+//Creates the operation run for a request received by repo
+type OperationFactory func(request *Request, repo *Repo) Operation
+
+//Registered command, create also receives the connection's session so built in commands
+//such as BEGIN and VERBOSE can change it
+type command struct {
+	rules  []Rule
+	create func(instruction *instruction, repo *Repo, session *session) Operation
+}
+
+var registry = struct {
+	sync.RWMutex
+	commands map[string]*command
+}{commands: make(map[string]*command)}
+
+//Adds a command to every Repo, requests for name are checked against rules in order and
+//then run through the Operation returned by factory. Commands must be registered before
+//any connection is handled, registering a name twice fails.
+//
+//	repomanager.Register("COUNT", newCountOperator, repomanager.NoPackage)
+func Register(name string, factory OperationFactory, rules ...Rule) error {
+	return register(name, func(instruction *instruction, repo *Repo, session *session) Operation {
+		return factory(instruction.request(), repo)
+	}, rules...)
+}
+
+func register(name string, create func(*instruction, *Repo, *session) Operation, rules ...Rule) error {
+
+	if name == "" || strings.ContainsAny(name, "|\n") {
+		return errors.New(fmt.Sprintf("Invalid command name:%q", name))
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, exists := registry.commands[name]; exists {
+		return errors.New(fmt.Sprintf("Command %s is already registered", name))
+	}
+
+	registry.commands[name] = &command{
+		rules:  rules,
+		create: create,
+	}
+	return nil
+}
+
+//Registers a built in command, failing to is a programming error
+func mustRegister(name string, create func(*instruction, *Repo, *session) Operation, rules ...Rule) {
+	err := register(name, create, rules...)
+	if err != nil {
+		panic(err)
+	}
+}
+
+//Returns the name of every registered command sorted alphabetically
+func Commands() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	names := make([]string, 0, len(registry.commands))
+	for name := range registry.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func lookupCommand(name string) (*command, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	c, exists := registry.commands[name]
+	return c, exists
+}
+
+//Removes a registered command, lets tests undo their registrations
+func unregister(name string) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	delete(registry.commands, name)
+}
+
+//Rule requiring the package to be a valid package name, optionally with @version
+func ValidPackage(request *Request) error {
+	return validatePackage(request.Package)
+}
+
+//Rule requiring every dependency to be a valid dependency spec
+func ValidDependencies(request *Request) error {
+	return validateDependencies(request.Dependencies)
+}
+
+//Rule for commands that take no package
+func NoPackage(request *Request) error {
+	if request.Package != "" {
+		return errors.New(fmt.Sprintf("%s takes no package", request.Command))
+	}
+	return nil
+}
+
+//Rule for commands that take no dependencies
+func NoDependencies(request *Request) error {
+	if len(request.Dependencies) > 0 {
+		return errors.New(fmt.Sprintf("%s takes no dependencies", request.Command))
+	}
+	return nil
+}
+
+//Turns a bool validator of the built in commands into a Rule
+func ruleFor(valid func(request *Request) bool) Rule {
+	return func(request *Request) error {
+		if !valid(request) {
+			return errors.New(fmt.Sprintf("Invalid arguments for %s", request.Command))
+		}
+		return nil
+	}
+}
+
+func (i *instruction) request() *Request {
+	return &Request{
+		Command:      i.cmd,
+		Package:      i.packageName,
+		Dependencies: i.packageDependencies,
+	}
+}
@@ -2,6 +2,15 @@ package repomanager
 
 const REMOVE string = "REMOVE"
 
+func init() {
+	mustRegister(REMOVE, func(instruction *instruction, repo *Repo, session *session) Operation {
+		if session.transaction != nil {
+			return NewQueueOperator(instruction, session)
+		}
+		return NewRemoveOperator(instruction, repo)
+	}, ValidPackage, ValidDependencies)
+}
+
 type RemoveOperator struct {
 	instruction *instruction
 	repo        *Repo
@@ -14,19 +23,21 @@ func NewRemoveOperator(instruction *instruction, repo *Repo) *RemoveOperator {
 	}
 }
 
-func (o RemoveOperator) Run() (string, error) {
+func (o RemoveOperator) Run(backend Backend) (string, error) {
 
-	o.repo.mu.Lock()
-	err := o.repo.backend.Remove(o.instruction.packageName)
-	o.repo.mu.Unlock()
+	err := o.repo.remove(backend, o.instruction.packageName)
 
 	if err != nil {
-		return FAIL, nil
+		return FAIL, err
 	}
 
 	return OK, nil
 }
 
+func (o RemoveOperator) Access() Access {
+	return ACCESS_WRITE
+}
+
 func (o RemoveOperator) GetCommand() string {
 	return o.instruction.cmd
 }
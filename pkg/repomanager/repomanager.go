@@ -1,13 +1,18 @@
 package repomanager
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"github.com/jrxfive/packagetree/pkg/graph"
+	"github.com/jrxfive/packagetree/pkg/logging"
+	"github.com/jrxfive/packagetree/pkg/server"
 	"net"
 	"regexp"
 	"strings"
-	"sync"
+	"time"
 	"unicode"
 )
 
@@ -16,23 +21,72 @@ const (
 	OK                     = "OK"
 	FAIL                   = "FAIL"
 	ERROR                  = "ERROR"
+	MAX_MESSAGE_LENGTH     = 64 * 1024
+	DEFAULT_IDLE_TIMEOUT   = 10 * time.Second
+	DEFAULT_LOCK_TIMEOUT   = 5 * time.Second
 )
 
+//How an operation uses the backend, Repo holds the matching lock for as long as Run runs
+type Access int
+
+const (
+	ACCESS_NONE Access = iota
+	ACCESS_READ
+	ACCESS_WRITE
+)
+
+var logger = logging.GetLogger()
 var allowedCharacters = regexp.MustCompile(`([a-zA-z\_\-\+\.\d]+)`)
+var errReadAccess = errors.New("Operations with read access can't change the backend")
+var errLockTimeout = errors.New("Gave up waiting for the repo lock")
+var errMessageTooLong = errors.New(fmt.Sprintf("Message exceeds %d bytes", MAX_MESSAGE_LENGTH))
 
 type Backend interface {
 	Exists(name string) bool
 	Add(name string, edges ...string) error
 	Remove(name string) error
+	Dependencies(name string) ([]string, error)
+	Dependents(name string) ([]string, error)
+	TransitiveDependents(name string) ([]string, error)
+	Order(name string) ([]string, error)
+}
+
+//Returned by backends that replicate another server's packages and can't change them,
+//Leader is the address INDEX and REMOVE should be sent to instead
+type ReadOnlyError struct {
+	Leader string
+}
+
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("Read only replica changes must be sent to:%v", e.Leader)
+}
+
+//Returned when removing a bare name such as openssl that isn't indexed itself while Versions
+//of it are. QUERY answers OK for such a name, so removing nothing would be misleading.
+type AmbiguousNameError struct {
+	Name     string
+	Versions []string
+}
+
+func (e *AmbiguousNameError) Error() string {
+	return fmt.Sprintf("%s is indexed as:%s remove a version by name", e.Name, strings.Join(e.Versions, ","))
 }
 
 type Repo struct {
-	backend Backend
-	mu      *sync.RWMutex
+	backend     Backend
+	sizer       Sizer
+	mu          *rwLock
+	watchers    *watchHub
+	idleTimeout time.Duration
+	lockTimeout time.Duration
 }
 
+//Command run by a Repo. Run is called holding the lock Access asks for and receives the
+//backend to use, a view refusing Add and Remove for ACCESS_READ and nil for ACCESS_NONE.
+//Operations must not keep the backend once Run returns.
 type Operation interface {
-	Run() (string, error)
+	Access() Access
+	Run(backend Backend) (string, error)
 	GetCommand() string
 }
 
@@ -44,12 +98,32 @@ type instruction struct {
 
 func NewRepo(graph Backend) *Repo {
 
+	sizer, _ := graph.(Sizer)
+
 	return &Repo{
-		backend: graph,
-		mu:      &sync.RWMutex{},
+		backend:     instrumentedBackend{backend: graph},
+		sizer:       sizer,
+		mu:          newRWLock(),
+		watchers:    newWatchHub(),
+		idleTimeout: DEFAULT_IDLE_TIMEOUT,
+		lockTimeout: DEFAULT_LOCK_TIMEOUT,
 	}
 }
 
+//Sets how long Handle waits for the next message before closing the connection, the
+//timeout starts over after every message. Zero waits forever. Must be set before any
+//connection is handled.
+func (r *Repo) SetIdleTimeout(timeout time.Duration) {
+	r.idleTimeout = timeout
+}
+
+//Sets how long an operation waits for the repo lock before giving up with ERROR, so a
+//stalled writer can't hold up every connection. Zero waits forever. Must be set before
+//any connection is handled.
+func (r *Repo) SetLockTimeout(timeout time.Duration) {
+	r.lockTimeout = timeout
+}
+
 func createInstructionSet(input []byte) (*instruction, error) {
 
 	var CMD_INDEX int = 0
@@ -70,20 +144,37 @@ func createInstructionSet(input []byte) (*instruction, error) {
 	}
 }
 
+//Splits the comma-delimited dependencies, an item starting with a constraint operator such as
+//<2 in libfoo>=1.2,<2 continues the dependency before it
 func getDependencyPackages(dependencies []byte) []string {
 	var dep []string
 
 	if len(dependencies) > 0 {
-		r := strings.SplitN(string(dependencies), ",", -1)
-
-		dep = r
+		for _, item := range strings.Split(string(dependencies), ",") {
+			if len(dep) > 0 && strings.IndexAny(item, graph.CONSTRAINT_CHARS) == 0 {
+				dep[len(dep)-1] += "," + item
+				continue
+			}
+			dep = append(dep, item)
+		}
 	}
 
 	return dep
 }
 
+//Validates a package name optionally followed by @version
 func validatePackage(packageName string) error {
 
+	name, _, err := graph.ParsePackage(packageName)
+	if err != nil {
+		return err
+	}
+
+	return validatePackageName(name)
+}
+
+func validatePackageName(packageName string) error {
+
 	packageNameLength := len(packageName)
 	allowedCharactersMatches := allowedCharacters.FindAllString(packageName, -1)
 
@@ -125,72 +216,255 @@ func validatePackage(packageName string) error {
 
 }
 
+//Validates dependency specs such as gmp, openssl@3 or libfoo>=1.2,<2
 func validateDependencies(dependencies []string) error {
 
-	for _, dependency := range dependencies {
-		return validatePackage(dependency)
+	for _, spec := range dependencies {
+		dependency, err := graph.ParseDependency(spec)
+		if err != nil {
+			return err
+		}
+
+		err = validatePackageName(dependency.Name)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func validateAndCreateOperator(instruction *instruction, repo *Repo) Operation {
+//Looks up the registered command for instruction, checks its rules and creates its
+//operation. Unknown commands and instructions failing a rule get the UnknownOperator.
+func validateAndCreateOperator(instruction *instruction, repo *Repo, session *session) Operation {
 
-	err := validatePackage(instruction.packageName)
-	if err != nil {
+	c, exists := lookupCommand(instruction.cmd)
+	if !exists {
 		return NewUnknownOperator()
 	}
 
-	err = validateDependencies(instruction.packageDependencies)
-	if err != nil {
-		return NewUnknownOperator()
+	request := instruction.request()
+	for _, rule := range c.rules {
+		if rule(request) != nil {
+			return NewUnknownOperator()
+		}
 	}
 
-	switch instruction.cmd {
-	case INDEX:
-		return NewIndexOperator(instruction, repo)
-	case REMOVE:
-		return NewRemoveOperator(instruction, repo)
-	case QUERY:
-		return NewQueryOperator(instruction, repo)
-	default:
-		return NewUnknownOperator()
+	return c.create(instruction, repo, session)
+}
+
+//Reads a single message terminated by \n. Messages longer than the reader's buffer are
+//consumed up to and including their \n and reported as errMessageTooLong so the
+//connection can carry on with the next message.
+func readMessage(reader *bufio.Reader) ([]byte, error) {
+
+	message, err := reader.ReadSlice('\n')
+	if err != bufio.ErrBufferFull {
+		return message, err
 	}
+
+	for err == bufio.ErrBufferFull {
+		_, err = reader.ReadSlice('\n')
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, errMessageTooLong
 }
 
-//Handles TCP connections for the repo manager. Will set a read dead line before
-//serving the connection to avoid stale connections. The buffer is set to 1024 bytes
-//this could have been more dynamic by using bufio instead of a static limit. After
+//Handles TCP connections for the repo manager. The connection is closed once the client
+//has been idle for the idle timeout, the deadline is pushed back after every message so
+//busy clients stay connected. Messages are framed on \n through a reader bounded to
+//MAX_MESSAGE_LENGTH bytes, longer messages are answered with ERROR. The subject of a mutual
+//TLS client's certificate is kept on the session for authorization. Once WATCH succeeds the
+//connection only receives events until it is closed.
+//Clients may pipeline several messages, each is run in the order received and the
+//responses are flushed once every complete message received has been answered. After
 //receiving and creating an instruction set it will run the corresponding command and
-//return the value based on the backend.
+//return the value based on the backend. Messages use the cmd|pkg|deps format, see
+//NewCodecHandler for other formats.
 func (r *Repo) Handle(conn net.Conn) {
+	r.handle(conn, PipeCodec{})
+}
+
+//Serves conn decoding messages and encoding responses with codec
+func (r *Repo) handle(conn net.Conn, codec Codec) {
+
+	defer conn.Close()
+
+	session := newSession()
+	if subject, ok := server.PeerSubject(conn); ok {
+		session.peer = &subject
+	}
+	defer func() {
+		if session.watcher != nil {
+			r.watchers.unsubscribe(session.watcher)
+		}
+	}()
+
+	reader := bufio.NewReaderSize(conn, MAX_MESSAGE_LENGTH)
+	writer := bufio.NewWriter(conn)
+	defer writer.Flush()
 
 	for {
-		//err := conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(r.readTimeout)))
-		//if err != nil {
-		//	conn.Close()
-		//	break
-		//}
+		//Responses are sent before reading further so a client waiting on them, or the
+		//drain notice written by the next read, never overtakes them
+		if !bufferedMessage(reader) {
+			if r.idleTimeout > 0 {
+				err := conn.SetDeadline(time.Now().Add(r.idleTimeout))
+				if err != nil {
+					break
+				}
+			}
+
+			err := writer.Flush()
+			if err != nil {
+				break
+			}
+		}
 
-		buffer := make([]byte, 1024)
+		var output string
+		var request *Request
 
-		bufferLength, err := conn.Read(buffer)
+		message, err := readMessage(reader)
+		if err == errMessageTooLong {
+			output = ERROR
+			countCommand(ERROR, output)
+		} else if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				connectionTimeoutsTotal.Inc()
+			}
+			break
+		} else {
+			request, err = codec.Decode(message)
+			if err != nil {
+				output = ERROR
+				countCommand(ERROR, output)
+			} else {
+				output = r.run(context.Background(), request, session)
+			}
+		}
+
+		//Running the request, e.g. a large COMMIT, may outlast the deadline set before reading it
+		if r.idleTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(r.idleTimeout))
+		}
+
+		_, err = writer.Write(codec.Encode(request, output))
 		if err != nil {
-			conn.Close()
 			break
 		}
 
-		instruction, err := createInstructionSet(buffer[:bufferLength])
+		if session.watcher != nil {
+			if writer.Flush() == nil {
+				r.watch(conn, reader, writer, session.watcher, func(event string) []byte {
+					return codec.Encode(request, event)
+				})
+			}
+			break
+		}
+	}
+}
+
+//Reports whether reader holds a complete message, reading it then won't block
+func bufferedMessage(reader *bufio.Reader) bool {
+	buffered, _ := reader.Peek(reader.Buffered())
+	return bytes.IndexByte(buffered, '\n') >= 0
+}
+
+//Validates and runs a single request returning the response to send back
+func (r *Repo) run(ctx context.Context, request *Request, session *session) string {
+	output, _ := r.runOperator(ctx, validateAndCreateOperator(request.instruction(), r, session), session)
+	return output
+}
+
+//Runs operator returning the response to send back and the error behind it, if any
+func (r *Repo) runOperator(ctx context.Context, operator Operation, session *session) (string, error) {
+
+	output, err := r.execute(ctx, operator)
+	output = session.respond(output, err)
+	countCommand(operator.GetCommand(), output)
+
+	return output, err
+}
+
+//Runs operator holding the lock it asked for. Operations that can't get the lock before
+//ctx is done or the lock timeout passes are answered with ERROR and errLockTimeout.
+func (r *Repo) execute(ctx context.Context, operator Operation) (string, error) {
+
+	switch operator.Access() {
+	case ACCESS_READ:
+		err := r.rlock(ctx)
 		if err != nil {
-			fmt.Fprintln(conn, ERROR)
-			continue
+			logger.Printf("%s gave up waiting for the read lock:%v\n", operator.GetCommand(), err)
+			return ERROR, errLockTimeout
 		}
+		defer r.runlock()
 
-		operator := validateAndCreateOperator(instruction, r)
-		output, err := operator.Run()
-		_, err = fmt.Fprintln(conn, output)
+		return operator.Run(readOnlyBackend{Backend: r.backend})
+	case ACCESS_WRITE:
+		err := r.lock(ctx)
 		if err != nil {
-			conn.Close()
+			logger.Printf("%s gave up waiting for the write lock:%v\n", operator.GetCommand(), err)
+			return ERROR, errLockTimeout
 		}
+		defer r.unlock()
+
+		return operator.Run(r.backend)
+	default:
+		return operator.Run(nil)
+	}
+}
+
+//Calls fn holding the read lock with the same view of the backend ACCESS_READ operations
+//get. Returns ctx's error without calling fn when the lock isn't acquired before ctx is done
+//or the lock timeout passes.
+func (r *Repo) View(ctx context.Context, fn func(backend Backend) error) error {
+
+	err := r.rlock(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.runlock()
+
+	return fn(readOnlyBackend{Backend: r.backend})
+}
+
+//Calls fn holding the write lock, see View
+func (r *Repo) Update(ctx context.Context, fn func(backend Backend) error) error {
+
+	err := r.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.unlock()
+
+	return fn(r.backend)
+}
+
+//Backend handed to ACCESS_READ operations, they only hold the read lock so changes fail
+type readOnlyBackend struct {
+	Backend
+}
+
+func (b readOnlyBackend) Add(name string, edges ...string) error {
+	return errReadAccess
+}
+
+func (b readOnlyBackend) Remove(name string) error {
+	return errReadAccess
+}
+
+func (b readOnlyBackend) Versions(name string) []string {
+	if versioner, ok := b.Backend.(Versioner); ok {
+		return versioner.Versions(name)
+	}
+	return nil
+}
 
+func (b readOnlyBackend) Walk(fn func(name string, edges []string) error) error {
+	if walker, ok := b.Backend.(Walker); ok {
+		return walker.Walk(fn)
 	}
+	return ErrListUnsupported
 }
@@ -1,11 +1,18 @@
 package repomanager
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"github.com/jrxfive/packagetree/pkg/graph"
 	"github.com/jrxfive/packagetree/pkg/server"
-	"math/rand"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -26,6 +33,18 @@ func (mb *MockBackend) Add(name string, edges ...string) error {
 		return errors.New("error")
 	}
 
+	if name == "missing-dependency" {
+		return &graph.MissingDependenciesError{Name: name, Missing: []string{"gmp", "isl"}}
+	}
+
+	if name == "cycle" {
+		return &graph.CycleError{Name: name, Cycle: []string{"cycle", "gmp", "cycle"}}
+	}
+
+	if name == "read-only" {
+		return &ReadOnlyError{Leader: "leader:8080"}
+	}
+
 	return nil
 }
 
@@ -34,12 +53,43 @@ func (mb *MockBackend) Remove(name string) error {
 		return errors.New("error")
 	}
 
+	if name == "has-dependents" {
+		return &graph.DependentsExistError{Name: name, Dependents: []string{"cloog"}}
+	}
+
 	return nil
 }
 
-func random(min, max int) int {
-	rand.Seed(time.Now().Unix())
-	return rand.Intn(max-min) + min
+func (mb *MockBackend) Dependencies(name string) ([]string, error) {
+	if name == "generate-error" {
+		return nil, errors.New("error")
+	}
+
+	return []string{"gmp", "isl"}, nil
+}
+
+func (mb *MockBackend) Dependents(name string) ([]string, error) {
+	if name == "generate-error" {
+		return nil, errors.New("error")
+	}
+
+	return []string{"cloog"}, nil
+}
+
+func (mb *MockBackend) TransitiveDependents(name string) ([]string, error) {
+	if name == "generate-error" {
+		return nil, errors.New("error")
+	}
+
+	return []string{"gcc", "cloog"}, nil
+}
+
+func (mb *MockBackend) Order(name string) ([]string, error) {
+	if name == "generate-error" {
+		return nil, errors.New("error")
+	}
+
+	return []string{"gmp", "isl", name}, nil
 }
 
 func TestValidatePackage(t *testing.T) {
@@ -56,6 +106,12 @@ func TestValidatePackage(t *testing.T) {
 		{"emacs elisp", true},
 		{"dvd+rw-tools", false},
 		{"g++", false},
+		{"openssl@3", false},
+		{"openssl@1.1.1k", false},
+		{"g++@4.9", false},
+		{"openssl@", true},
+		{"openssl@3@4", true},
+		{"openssl@>3", true},
 	}
 
 	for _, test := range tests {
@@ -97,10 +153,36 @@ func TestValidateAndCreateOperator(t *testing.T) {
 		{&instruction{"REMOVE", "g++", []string{"bar"}}, r, "REMOVE"},
 		{&instruction{"REMOV", "emacs=elisp", []string{}}, r, "ERROR"},
 		{&instruction{"REM", "g++", []string{}}, r, "ERROR"},
+		{&instruction{"DEPS", "g++", []string{}}, r, "DEPS"},
+		{&instruction{"DEPS", "emacs=elisp", []string{}}, r, "ERROR"},
+		{&instruction{"RDEPS", "g++", []string{}}, r, "RDEPS"},
+		{&instruction{"RDEPS", "g++", []string{"transitive"}}, r, "RDEPS"},
+		{&instruction{"RDEPS", "g++", []string{"bar"}}, r, "ERROR"},
+		{&instruction{"RDEPS", "g++", []string{"transitive", "bar"}}, r, "ERROR"},
+		{&instruction{"VERBOSE", "on", []string{}}, r, "VERBOSE"},
+		{&instruction{"VERBOSE", "off", []string{}}, r, "VERBOSE"},
+		{&instruction{"VERBOSE", "yes", []string{}}, r, "ERROR"},
+		{&instruction{"ORDER", "g++", []string{}}, r, "ORDER"},
+		{&instruction{"ORDER", "emacs=elisp", []string{}}, r, "ERROR"},
+		{&instruction{"BEGIN", "", []string{}}, r, "BEGIN"},
+		{&instruction{"COMMIT", "", []string{}}, r, "COMMIT"},
+		{&instruction{"ROLLBACK", "", []string{}}, r, "ROLLBACK"},
+		{&instruction{"INDEX", "app@1.0", []string{"libfoo>=1.2,<2", "openssl@3"}}, r, "INDEX"},
+		{&instruction{"INDEX", "app@", []string{}}, r, "ERROR"},
+		{&instruction{"INDEX", "app", []string{"gmp", "libfoo>="}}, r, "ERROR"},
+		{&instruction{"INDEX", "app", []string{"gmp", "emacs elisp"}}, r, "ERROR"},
+		{&instruction{"QUERY", "openssl@3", []string{}}, r, "QUERY"},
+		{&instruction{"WATCH", "lib*", []string{}}, r, "WATCH"},
+		{&instruction{"WATCH", "[", []string{}}, r, "ERROR"},
+		{&instruction{"WATCH", "", []string{}}, r, "ERROR"},
+		{&instruction{"WATCH", "*", []string{"bar"}}, r, "ERROR"},
+		{&instruction{"LIST", "", []string{}}, r, "LIST"},
+		{&instruction{"LIST", "g++", []string{}}, r, "ERROR"},
+		{&instruction{"LIST", "", []string{"bar"}}, r, "ERROR"},
 	}
 
 	for _, test := range tests {
-		if output := validateAndCreateOperator(test.instruction, test.repo); output.GetCommand() != test.expectedCommand {
+		if output := validateAndCreateOperator(test.instruction, test.repo, newSession()); output.GetCommand() != test.expectedCommand {
 			t.Errorf("validateAndCreateOperator(%#v) = %s, expected:%s", test.instruction, output.GetCommand(), test.expectedCommand)
 		}
 	}
@@ -118,6 +200,9 @@ func TestCreateInstructionSet(t *testing.T) {
 		{[]byte("INDEX|boo|\n"), "INDEX", "boo", 0, false},
 		{[]byte("INDEX|boo|foo\n"), "INDEX", "boo", 1, false},
 		{[]byte("INDEX|boo|foo,bar\n"), "INDEX", "boo", 2, false},
+		{[]byte("INDEX|boo@1.0|openssl@3,bar\n"), "INDEX", "boo@1.0", 2, false},
+		{[]byte("INDEX|boo|libfoo>=1.2,<2,bar\n"), "INDEX", "boo", 2, false},
+		{[]byte("INDEX|boo|libfoo>=1.2,<2,!=1.5\n"), "INDEX", "boo", 1, false},
 		{[]byte("QUERY"), "", "", 0, true},
 	}
 
@@ -151,20 +236,13 @@ func TestCreateInstructionSet(t *testing.T) {
 
 func TestHandle(t *testing.T) {
 
-	port := random(1025, 9999)
-
-	go func() {
-		r := NewRepo(&MockBackend{})
-		configuration := server.NewServerConfiguration(r, port, 1, 10)
-
-		err := server.Listen(configuration)
-		if err != nil {
-			fmt.Println(err)
-			t.Fatal(err)
-		}
-	}()
-
-	time.Sleep(1 * time.Second)
+	r := NewRepo(&MockBackend{})
+	s, err := server.NewServer(server.NewServerConfiguration(r, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	go s.Serve(context.Background())
 
 	var connections = []struct {
 		rawCommand              string
@@ -178,10 +256,27 @@ func TestHandle(t *testing.T) {
 		{"INDEX|generate-error|", FAIL, false},
 		{"QUERY|generate-error|", FAIL, false},
 		{"REMOVE|generate-error|", FAIL, false},
+		{"DEPS|boo|", "OK|gmp,isl", false},
+		{"DEPS|generate-error|", FAIL, false},
+		{"RDEPS|boo|", "OK|cloog", false},
+		{"RDEPS|boo|transitive", "OK|gcc,cloog", false},
+		{"RDEPS|generate-error|", FAIL, false},
+		{"ORDER|boo|", "OK|gmp,isl,boo", false},
+		{"ORDER|generate-error|", FAIL, false},
+		{"INDEX|missing-dependency|gmp,isl", FAIL, false},
+		{"VERBOSE|on|", OK, false},
+		{"INDEX|missing-dependency|gmp,isl", "FAIL|MISSING_DEPENDENCIES|gmp,isl", false},
+		{"REMOVE|has-dependents|", "FAIL|HAS_DEPENDENTS|cloog", false},
+		{"INDEX|cycle|gmp", "FAIL|CYCLE|cycle,gmp,cycle", false},
+		{"INDEX|generate-error|", "FAIL|BACKEND_ERROR|", false},
+		{"INDEX|read-only|", "FAIL|READ_ONLY|leader:8080", false},
+		{"QUERY|generate-error|", FAIL, false},
+		{"VERBOSE|off|", OK, false},
+		{"REMOVE|has-dependents|", FAIL, false},
 		{"REMOVE|boo|", "", true},
 	}
 
-	c, err := net.Dial("tcp", fmt.Sprintf(":%v", port))
+	c, err := net.Dial("tcp", s.Addr().String())
 	if err != nil {
 		t.Fatalf("Failed to establish connection to repo server")
 	}
@@ -214,3 +309,1041 @@ func TestHandle(t *testing.T) {
 
 	c.Close()
 }
+
+//Serves handler on a loopback listener for the lifetime of the test, returning its address
+func serveRepo(handler server.ConnectionHandler, t *testing.T) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handler.Handle(conn)
+		}
+	}()
+
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+func TestHandleFraming(t *testing.T) {
+
+	addr, closeListener := serveRepo(NewRepo(&MockBackend{}), t)
+	defer closeListener()
+
+	longDependencies := strings.Repeat("dependency,", 200) + "dependency"
+	tooLong := strings.Repeat("a", MAX_MESSAGE_LENGTH)
+
+	var tests = []struct {
+		name     string
+		writes   []string
+		expected string
+	}{
+		{"pipelined", []string{"INDEX|boo|\nQUERY|boo|\nDEPS|boo|\n"}, "OK\nOK\nOK|gmp,isl\n"},
+		{"split", []string{"INDEX|bo", "o|foo,b", "ar\n"}, "OK\n"},
+		{"long dependencies", []string{"INDEX|boo|" + longDependencies + "\n"}, "OK\n"},
+		{"too long", []string{"INDEX|boo|" + tooLong + "\nQUERY|boo|\n"}, "ERROR\nOK\n"},
+		{"pipelined errors", []string{"QRY|boo|\nINDEX|generate-error|\nREMOVE|boo|\n"}, "ERROR\nFAIL\nOK\n"},
+		{"partial next message", []string{"QUERY|boo|\nQUE"}, "OK\n"},
+		{"partial next message pipelined", []string{"INDEX|boo|\nQUERY|boo|\nDE", "PS|boo|\n"}, "OK\nOK\nOK|gmp,isl\n"},
+	}
+
+	for _, test := range tests {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to establish connection to repo server")
+		}
+
+		for _, write := range test.writes {
+			_, err = c.Write([]byte(write))
+			if err != nil {
+				t.Error(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		c.SetReadDeadline(time.Now().Add(time.Second * 3))
+		response := make([]byte, len(test.expected))
+		_, err = io.ReadFull(c, response)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+
+		if string(response) != test.expected {
+			t.Errorf("%s: Expected:%q Got:%q", test.name, test.expected, string(response))
+		}
+
+		c.Close()
+	}
+}
+
+func TestHandleDrain(t *testing.T) {
+
+	r := NewRepo(&MockBackend{})
+	s, err := server.NewServer(server.NewServerConfiguration(r, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(context.Background())
+
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to establish connection to repo server")
+	}
+	defer c.Close()
+
+	//The response to the complete message goes out ahead of the drain notice
+	fmt.Fprint(c, "QUERY|boo|\nQUE")
+	time.Sleep(100 * time.Millisecond)
+	s.Shutdown(context.Background())
+
+	c.SetReadDeadline(time.Now().Add(time.Second * 3))
+	response, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expected := OK + "\n" + server.DEFAULT_DRAIN_NOTICE + "\n"
+	if string(response) != expected {
+		t.Errorf("Expected:%q Got:%q", expected, string(response))
+	}
+}
+
+//Counts the dependencies of a package, registered by TestRegister
+type countOperator struct {
+	request *Request
+}
+
+func (o countOperator) Access() Access {
+	return ACCESS_READ
+}
+
+func (o countOperator) Run(backend Backend) (string, error) {
+
+	dependencies, err := backend.Dependencies(o.request.Package)
+	if err != nil {
+		return FAIL, nil
+	}
+	return fmt.Sprintf("%s|%d", OK, len(dependencies)), nil
+}
+
+func (o countOperator) GetCommand() string {
+	return o.request.Command
+}
+
+func TestRegister(t *testing.T) {
+
+	err := Register("COUNT", func(request *Request, repo *Repo) Operation {
+		return countOperator{request: request}
+	}, ValidPackage, NoDependencies)
+	if err != nil {
+		t.Fatalf("Failed to register COUNT:%v", err)
+	}
+	defer unregister("COUNT")
+
+	var registrations = []struct {
+		name string
+	}{
+		{"COUNT"},
+		{"INDEX"},
+		{""},
+		{"CO|UNT"},
+	}
+
+	for _, registration := range registrations {
+		err := Register(registration.name, func(request *Request, repo *Repo) Operation {
+			return NewUnknownOperator()
+		})
+		if err == nil {
+			t.Errorf("Register(%q) should fail", registration.name)
+		}
+	}
+
+	commands := strings.Join(Commands(), ",")
+	for _, name := range []string{"COUNT", "INDEX", "REMOVE", "QUERY", "WATCH"} {
+		if !strings.Contains(commands, name) {
+			t.Errorf("Commands() = %s, missing:%s", commands, name)
+		}
+	}
+
+	g, _ := graph.NewGraph()
+	addr, closeListener := serveRepo(NewRepo(g), t)
+	defer closeListener()
+
+	var commandsSent = []struct {
+		rawCommand          string
+		expectedReturnValue string
+	}{
+		{"COUNT|cloog|", FAIL},
+		{"INDEX|gmp|", OK},
+		{"INDEX|isl|", OK},
+		{"INDEX|cloog|gmp,isl", OK},
+		{"COUNT|cloog|", "OK|2"},
+		{"COUNT|gmp|", "OK|0"},
+		{"COUNT|cloog|gmp", ERROR},
+		{"COUNT|emacs=elisp|", ERROR},
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to establish connection to repo server")
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(c)
+
+	for _, command := range commandsSent {
+		fmt.Fprintln(c, command.rawCommand)
+
+		line, err := reader.ReadString('\n')
+		if err != nil || line != command.expectedReturnValue+"\n" {
+			t.Errorf("Command:%s Expected:%s Got:%q %v", command.rawCommand, command.expectedReturnValue, line, err)
+		}
+	}
+}
+
+func TestRWLock(t *testing.T) {
+
+	l := newRWLock()
+	expired, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if l.RLock(context.Background()) != nil || l.RLock(context.Background()) != nil {
+		t.Fatalf("Readers should share the lock")
+	}
+	if err := l.Lock(expired); err != context.DeadlineExceeded {
+		t.Errorf("Lock held by readers = %v, expected:%v", err, context.DeadlineExceeded)
+	}
+	l.RUnlock()
+	l.RUnlock()
+
+	if l.Lock(context.Background()) != nil {
+		t.Fatalf("Lock released by every reader should be acquired")
+	}
+
+	//A writer waiting behind a reader keeps later readers out
+	writerDone := make(chan error, 1)
+	go func() {
+		err := l.Lock(context.Background())
+		if err == nil {
+			l.Unlock()
+		}
+		writerDone <- err
+	}()
+
+	readerDone := make(chan error, 1)
+	time.AfterFunc(50*time.Millisecond, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		readerDone <- l.RLock(ctx)
+	})
+
+	if err := <-readerDone; err != context.DeadlineExceeded {
+		t.Errorf("RLock behind a waiting writer = %v, expected:%v", err, context.DeadlineExceeded)
+	}
+
+	l.Unlock()
+	if err := <-writerDone; err != nil {
+		t.Errorf("Waiting writer = %v, expected to acquire the lock", err)
+	}
+
+	if l.RLock(context.Background()) != nil {
+		t.Errorf("Readers should acquire the lock once the writer is done")
+	}
+	l.RUnlock()
+}
+
+func TestLockTimeout(t *testing.T) {
+
+	g, _ := graph.NewGraph()
+	r := NewRepo(g)
+	r.SetLockTimeout(100 * time.Millisecond)
+
+	addr, closeListener := serveRepo(r, t)
+	defer closeListener()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to establish connection to repo server")
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(c)
+
+	send := func(rawCommand, expectedReturnValue string) {
+		fmt.Fprintln(c, rawCommand)
+		line, err := reader.ReadString('\n')
+		if err != nil || line != expectedReturnValue+"\n" {
+			t.Errorf("Command:%s Expected:%s Got:%q %v", rawCommand, expectedReturnValue, line, err)
+		}
+	}
+
+	send("INDEX|gmp|", OK)
+
+	//A stalled writer makes every operation needing the lock give up, others still run
+	stalled := make(chan struct{})
+	released := make(chan struct{})
+	go func() {
+		r.Update(context.Background(), func(backend Backend) error {
+			close(stalled)
+			<-released
+			return nil
+		})
+	}()
+	<-stalled
+
+	send("QUERY|gmp|", ERROR)
+	send("INDEX|isl|", ERROR)
+	send("VERBOSE|on|", OK)
+
+	close(released)
+
+	send("QUERY|gmp|", OK)
+	send("INDEX|isl|", OK)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.View(ctx, func(backend Backend) error { return nil }); err != context.Canceled {
+		t.Errorf("View with a cancelled context = %v, expected:%v", err, context.Canceled)
+	}
+
+	err = r.View(context.Background(), func(backend Backend) error {
+		return backend.Add("cloog", "gmp")
+	})
+	if err != errReadAccess {
+		t.Errorf("Add from View = %v, expected:%v", err, errReadAccess)
+	}
+}
+
+func TestRepoAPI(t *testing.T) {
+
+	g, _ := graph.NewGraph()
+	r := NewRepo(g)
+	ctx := context.Background()
+
+	w := r.watchers.subscribe("*")
+	defer r.watchers.unsubscribe(w)
+
+	if err := r.Index(ctx, "gmp"); err != nil {
+		t.Fatalf("Index(gmp) = %v, expected:nil", err)
+	}
+	if err := r.Index(ctx, "isl", "gmp"); err != nil {
+		t.Fatalf("Index(isl) = %v, expected:nil", err)
+	}
+	if err := r.Index(ctx, "openssl@3"); err != nil {
+		t.Fatalf("Index(openssl@3) = %v, expected:nil", err)
+	}
+
+	if event := <-w.events; event != "INDEXED|gmp|" {
+		t.Errorf("Index(gmp) published:%q, expected:%q", event, "INDEXED|gmp|")
+	}
+
+	if err := r.Index(ctx, "cloog", "gmp", "ppl"); err == nil {
+		t.Errorf("Index(cloog) with a missing dependency should fail")
+	} else if _, ok := err.(*graph.MissingDependenciesError); !ok {
+		t.Errorf("Index(cloog) = %#v, expected:*graph.MissingDependenciesError", err)
+	}
+
+	if err := r.Index(ctx, "emacs=elisp"); err == nil {
+		t.Errorf("Index(emacs=elisp) should fail")
+	} else if _, ok := err.(*RequestError); !ok {
+		t.Errorf("Index(emacs=elisp) = %#v, expected:*RequestError", err)
+	}
+
+	if err := r.Remove(ctx, "gmp"); err == nil {
+		t.Errorf("Remove(gmp) with dependents should fail")
+	} else if _, ok := err.(*graph.DependentsExistError); !ok {
+		t.Errorf("Remove(gmp) = %#v, expected:*graph.DependentsExistError", err)
+	}
+
+	var queries = []struct {
+		name     string
+		expected bool
+	}{
+		{"gmp", true},
+		{"openssl", true},
+		{"openssl@3", true},
+		{"openssl@1.1", false},
+		{"cloog", false},
+	}
+
+	for _, query := range queries {
+		if exists, err := r.Query(ctx, query.name); err != nil || exists != query.expected {
+			t.Errorf("Query(%s) = %v %v, expected:%v", query.name, exists, err, query.expected)
+		}
+	}
+
+	if dependencies, err := r.Dependencies(ctx, "isl"); err != nil || strings.Join(dependencies, ",") != "gmp" {
+		t.Errorf("Dependencies(isl) = %v %v, expected:[gmp]", dependencies, err)
+	}
+	if dependents, err := r.Dependents(ctx, "gmp", true); err != nil || strings.Join(dependents, ",") != "isl" {
+		t.Errorf("Dependents(gmp) = %v %v, expected:[isl]", dependents, err)
+	}
+	if order, err := r.Order(ctx, "isl"); err != nil || strings.Join(order, ",") != "gmp,isl" {
+		t.Errorf("Order(isl) = %v %v, expected:[gmp isl]", order, err)
+	}
+	if _, err := r.Order(ctx, "cloog"); err != ErrNotIndexed {
+		t.Errorf("Order(cloog) = %v, expected:%v", err, ErrNotIndexed)
+	}
+	if packages, err := r.List(ctx); err != nil || strings.Join(packages, ",") != "gmp,isl,openssl@3" {
+		t.Errorf("List() = %v %v, expected:[gmp isl openssl@3]", packages, err)
+	}
+	if _, err := NewRepo(&MockBackend{}).List(ctx); err != ErrListUnsupported {
+		t.Errorf("List() without a Walker = %v, expected:%v", err, ErrListUnsupported)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := r.Remove(cancelled, "isl"); err != context.Canceled {
+		t.Errorf("Remove(isl) with a cancelled context = %v, expected:%v", err, context.Canceled)
+	}
+
+	if err := r.Remove(ctx, "isl"); err != nil {
+		t.Errorf("Remove(isl) = %v, expected:nil", err)
+	}
+	if exists, _ := r.Query(ctx, "isl"); exists {
+		t.Errorf("Query(isl) after Remove = true, expected:false")
+	}
+}
+
+func TestHandleIdleTimeout(t *testing.T) {
+
+	r := NewRepo(&MockBackend{})
+	r.SetIdleTimeout(300 * time.Millisecond)
+
+	addr, closeListener := serveRepo(r, t)
+	defer closeListener()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to establish connection to repo server")
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(c)
+
+	//Keeps the connection busy for longer than the idle timeout
+	for idx := 0; idx < 5; idx++ {
+		fmt.Fprintln(c, "QUERY|boo|")
+		line, err := reader.ReadString('\n')
+		if err != nil || line != "OK\n" {
+			t.Fatalf("Message %d Expected:%q Got:%q %v", idx, "OK\n", line, err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	fmt.Fprintln(c, "QUERY|boo|")
+	if line, err := reader.ReadString('\n'); err == nil {
+		t.Errorf("Connection should be closed once idle, Got:%q", line)
+	}
+}
+
+func TestVersionedPackages(t *testing.T) {
+
+	g, _ := graph.NewGraph()
+	addr, closeListener := serveRepo(NewRepo(g), t)
+	defer closeListener()
+
+	var commands = []struct {
+		rawCommand          string
+		expectedReturnValue string
+	}{
+		{"QUERY|openssl|", FAIL},
+		{"INDEX|openssl@1.1|", OK},
+		{"INDEX|openssl@3|", OK},
+		{"INDEX|libfoo@1.2|", OK},
+		{"INDEX|libfoo@2.1|", OK},
+		{"QUERY|openssl|", OK},
+		{"QUERY|openssl@3|", OK},
+		{"QUERY|openssl@2|", FAIL},
+		{"INDEX|app@1.0|libfoo>=1.2,<2,openssl", OK},
+		{"DEPS|app@1.0|", "OK|libfoo@1.2,openssl@3"},
+		{"INDEX|app@2.0|openssl<3", OK},
+		{"DEPS|app@2.0|", "OK|openssl@1.1"},
+		{"VERBOSE|on|", OK},
+		{"INDEX|app@3.0|libfoo>=3,gmp", "FAIL|MISSING_DEPENDENCIES|libfoo>=3,gmp"},
+		{"REMOVE|openssl@3|", "FAIL|HAS_DEPENDENTS|app@1.0"},
+		{"QUERY|app|", OK},
+		{"REMOVE|openssl|", "FAIL|AMBIGUOUS_NAME|openssl@1.1,openssl@3"},
+		{"REMOVE|libfoo|", "FAIL|AMBIGUOUS_NAME|libfoo@1.2,libfoo@2.1"},
+		{"QUERY|openssl|", OK},
+		{"BEGIN||", OK},
+		{"REMOVE|libfoo|", OK},
+		{"COMMIT||", "FAIL|AMBIGUOUS_NAME|libfoo@1.2,libfoo@2.1"},
+		{"REMOVE|libfoo@2.1|", OK},
+		{"REMOVE|libfoo|", "FAIL|AMBIGUOUS_NAME|libfoo@1.2"},
+		{"REMOVE|missing|", OK},
+		{"VERBOSE|off|", OK},
+		{"REMOVE|openssl|", FAIL},
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to establish connection to repo server")
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(c)
+
+	for _, command := range commands {
+		fmt.Fprintln(c, command.rawCommand)
+
+		line, err := reader.ReadString('\n')
+		if err != nil || line != command.expectedReturnValue+"\n" {
+			t.Errorf("Command:%s Expected:%s Got:%q %v", command.rawCommand, command.expectedReturnValue, line, err)
+		}
+	}
+}
+
+func TestJSONCodec(t *testing.T) {
+
+	g, _ := graph.NewGraph()
+	addr, closeListener := serveRepo(NewCodecHandler(NewRepo(g), JSONCodec{}), t)
+	defer closeListener()
+
+	var commands = []struct {
+		request  string
+		expected string
+	}{
+		{`{"id":"1","command":"INDEX","package":"gmp"}`, `{"id":"1","name":"gmp","status":"OK"}`},
+		{`{"id":"2","command":"INDEX","package":"cloog","dependencies":["gmp","isl>=0.20,<1"]}`, `{"id":"2","name":"cloog","status":"FAIL"}`},
+		{`{"id":"3","command":"VERBOSE","package":"on"}`, `{"id":"3","name":"on","status":"OK"}`},
+		{`{"id":"4","command":"INDEX","package":"cloog","dependencies":["gmp","isl>=0.20,<1"]}`, `{"id":"4","name":"cloog","status":"FAIL","reason":"MISSING_DEPENDENCIES","packages":["isl\u003e=0.20,\u003c1"]}`},
+		{`{"id":"5","command":"INDEX","package":"isl@0.21","dependencies":["gmp"]}`, `{"id":"5","name":"isl@0.21","status":"OK"}`},
+		{`{"id":"6","command":"DEPS","package":"isl@0.21"}`, `{"id":"6","name":"isl@0.21","status":"OK","packages":["gmp"]}`},
+		{`{"command":"QUERY","package":"gmp"}`, `{"name":"gmp","status":"OK"}`},
+		{`{"id":"7","command":"QRY","package":"gmp"}`, `{"id":"7","name":"gmp","status":"ERROR"}`},
+		{`QUERY|gmp|`, `{"name":"","status":"ERROR"}`},
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to establish connection to repo server")
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(c)
+
+	for _, command := range commands {
+		fmt.Fprintln(c, command.request)
+
+		line, err := reader.ReadString('\n')
+		if err != nil || line != command.expected+"\n" {
+			t.Errorf("Request:%s Expected:%s Got:%q %v", command.request, command.expected, line, err)
+		}
+	}
+
+	fmt.Fprintln(c, `{"id":"w","command":"WATCH","package":"*"}`)
+	if line, _ := reader.ReadString('\n'); line != `{"id":"w","name":"*","status":"OK"}`+"\n" {
+		t.Fatalf("WATCH Got:%q", line)
+	}
+
+	other, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to establish connection to repo server")
+	}
+	defer other.Close()
+
+	fmt.Fprintln(other, `{"command":"INDEX","package":"cloog","dependencies":["gmp","isl>=0.20,<1"]}`)
+	expected := `{"id":"w","name":"cloog","status":"INDEXED","packages":["gmp","isl\u003e=0.20,\u003c1"]}` + "\n"
+	if line, err := reader.ReadString('\n'); err != nil || line != expected {
+		t.Errorf("Expected:%q Got:%q %v", expected, line, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+
+	g, _ := graph.NewGraph()
+	addr, closeListener := serveRepo(NewRepo(g), t)
+	defer closeListener()
+
+	watcher, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to establish connection to repo server")
+	}
+	defer watcher.Close()
+
+	watcher.SetReadDeadline(time.Now().Add(3 * time.Second))
+	events := bufio.NewReader(watcher)
+
+	//Messages pipelined after WATCH are ignored
+	fmt.Fprint(watcher, "WATCH|lib*|\nQUERY|libfoo|\n")
+	if line, err := events.ReadString('\n'); err != nil || line != "OK\n" {
+		t.Fatalf("WATCH Expected:%q Got:%q %v", "OK\n", line, err)
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to establish connection to repo server")
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	responses := bufio.NewReader(c)
+
+	for _, command := range []string{
+		"INDEX|libfoo|",
+		"INDEX|gmp|",
+		"INDEX|libbar|libfoo,gmp",
+		"INDEX|libbaz|missing",
+		"REMOVE|libbar|",
+		"REMOVE|libnothing|",
+		"BEGIN||",
+		"INDEX|libqux|libfoo",
+		"REMOVE|libnothing|",
+		"COMMIT||",
+	} {
+		fmt.Fprintln(c, command)
+		if _, err := responses.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, expected := range []string{
+		"INDEXED|libfoo|\n",
+		"INDEXED|libbar|libfoo,gmp\n",
+		"REMOVED|libbar|\n",
+		"INDEXED|libqux|libfoo\n",
+	} {
+		line, err := events.ReadString('\n')
+		if err != nil || line != expected {
+			t.Errorf("Expected:%q Got:%q %v", expected, line, err)
+		}
+	}
+}
+
+func TestWatchAfterIdle(t *testing.T) {
+
+	g, _ := graph.NewGraph()
+	r := NewRepo(g)
+	r.SetIdleTimeout(300 * time.Millisecond)
+
+	addr, closeListener := serveRepo(r, t)
+	defer closeListener()
+
+	watcher, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to establish connection to repo server")
+	}
+	defer watcher.Close()
+
+	watcher.SetReadDeadline(time.Now().Add(5 * time.Second))
+	events := bufio.NewReader(watcher)
+
+	fmt.Fprintln(watcher, "WATCH|*|")
+	if line, err := events.ReadString('\n'); err != nil || line != "OK\n" {
+		t.Fatalf("WATCH Expected:%q Got:%q %v", "OK\n", line, err)
+	}
+
+	//Quiet for longer than the idle timeout, then a burst well over the write buffer
+	time.Sleep(time.Second)
+
+	prefix := "package-" + strings.Repeat("x", 40) + "-"
+	err = r.Update(context.Background(), func(backend Backend) error {
+		for idx := 0; idx < 200; idx++ {
+			err := r.index(backend, fmt.Sprintf("%s%d", prefix, idx), nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for idx := 0; idx < 200; idx++ {
+		expected := fmt.Sprintf("%s|%s%d|\n", INDEXED, prefix, idx)
+		if line, err := events.ReadString('\n'); err != nil || line != expected {
+			t.Fatalf("Event %d Expected:%q Got:%q %v", idx, expected, line, err)
+		}
+	}
+}
+
+func TestWatchOverflow(t *testing.T) {
+
+	r := NewRepo(&MockBackend{})
+	w := r.watchers.subscribe("*")
+
+	for idx := 0; idx <= WATCH_BUFFER_SIZE; idx++ {
+		r.watchers.publish(&instruction{cmd: INDEX, packageName: "boo"})
+	}
+
+	select {
+	case <-w.dropped:
+	default:
+		t.Fatal("Watcher should be dropped once its buffer is full")
+	}
+
+	if len(r.watchers.watchers) != 0 {
+		t.Errorf("Dropped watcher should be unsubscribed")
+	}
+}
+
+func TestTransactionOrder(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		indexed  []string
+		queued   []string
+		expected string
+	}{
+		{"dependencies first", nil, []string{"INDEX|cloog|gmp,isl", "INDEX|isl|gmp", "INDEX|gmp|"}, "gmp,isl,cloog"},
+		{"queued order kept", nil, []string{"INDEX|b|", "INDEX|a|", "INDEX|c|"}, "b,a,c"},
+		{"versions", nil, []string{"INDEX|app|libfoo>=1.2,<2", "INDEX|libfoo@2.0|", "INDEX|libfoo@1.2|"}, "libfoo@2.0,libfoo@1.2,app"},
+		{"dependents removed first", []string{"INDEX|gmp|", "INDEX|isl|gmp", "INDEX|cloog|gmp,isl"}, []string{"REMOVE|gmp|", "REMOVE|isl|", "REMOVE|cloog|"}, "cloog,isl,gmp"},
+		{"dependent re-indexed first", []string{"INDEX|gmp|", "INDEX|isl|gmp"}, []string{"REMOVE|gmp|", "INDEX|isl|"}, "isl,gmp"},
+		{"dependent kept", []string{"INDEX|gmp|", "INDEX|isl|gmp"}, []string{"REMOVE|gmp|", "INDEX|isl|gmp"}, "gmp,isl"},
+		{"same package", nil, []string{"INDEX|isl|gmp", "REMOVE|isl|", "INDEX|gmp|", "INDEX|isl|"}, "gmp,isl,isl,isl"},
+		{"cycle", nil, []string{"INDEX|a|b", "INDEX|b|a", "INDEX|c|"}, "c,a,b"},
+	}
+
+	for _, test := range tests {
+		g, _ := graph.NewGraph()
+		for _, raw := range test.indexed {
+			i, _ := createInstructionSet([]byte(raw))
+			g.Add(i.packageName, i.packageDependencies...)
+		}
+
+		tx := &transaction{}
+		for _, raw := range test.queued {
+			i, err := createInstructionSet([]byte(raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx.instructions = append(tx.instructions, i)
+		}
+
+		var names []string
+		for _, i := range tx.sort(g) {
+			names = append(names, i.packageName)
+		}
+
+		if strings.Join(names, ",") != test.expected {
+			t.Errorf("%s: sort = %s, expected:%s", test.name, strings.Join(names, ","), test.expected)
+		}
+	}
+}
+
+func TestTransactionCommitSize(t *testing.T) {
+
+	g, _ := graph.NewGraph()
+	tx := &transaction{}
+
+	//Every package depends on the one queued after it, the worst order to apply them in
+	for idx := MAX_TRANSACTION_SIZE; idx > 0; idx-- {
+		tx.instructions = append(tx.instructions, &instruction{
+			cmd:                 INDEX,
+			packageName:         fmt.Sprintf("package-%d", idx),
+			packageDependencies: []string{fmt.Sprintf("package-%d", idx-1)},
+		})
+	}
+	tx.instructions = append(tx.instructions, &instruction{cmd: INDEX, packageName: "package-0"})
+
+	start := time.Now()
+	changes, err := tx.commit(g)
+	if err != nil || len(changes) != MAX_TRANSACTION_SIZE+1 {
+		t.Fatalf("commit = %d changes %v, expected:%d changes", len(changes), err, MAX_TRANSACTION_SIZE+1)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Committing %d instructions took %v", MAX_TRANSACTION_SIZE+1, elapsed)
+	}
+
+	tx = &transaction{}
+	for idx := 0; idx <= MAX_TRANSACTION_SIZE; idx++ {
+		tx.instructions = append(tx.instructions, &instruction{cmd: REMOVE, packageName: fmt.Sprintf("package-%d", idx)})
+	}
+
+	start = time.Now()
+	if _, err := tx.commit(g); err != nil || g.Len() != 0 {
+		t.Fatalf("commit = %v with %d packages left, expected every package removed", err, g.Len())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Removing %d packages took %v", MAX_TRANSACTION_SIZE+1, elapsed)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+
+	g, _ := graph.NewGraph()
+	g.Add("keep")
+	addr, closeListener := serveRepo(NewRepo(g), t)
+	defer closeListener()
+
+	var commands = []struct {
+		rawCommand          string
+		expectedReturnValue string
+	}{
+		{"COMMIT||", ERROR},
+		{"ROLLBACK||", ERROR},
+		{"BEGIN||", OK},
+		{"BEGIN||", ERROR},
+		{"INDEX|cloog|gmp,isl", OK},
+		{"INDEX|isl|gmp", OK},
+		{"INDEX|gmp|", OK},
+		{"QUERY|cloog|", FAIL},
+		{"COMMIT||", OK},
+		{"QUERY|cloog|", OK},
+		{"QUERY|isl|", OK},
+		{"BEGIN||", OK},
+		{"REMOVE|gmp|", OK},
+		{"REMOVE|cloog|", OK},
+		{"REMOVE|isl|", OK},
+		{"INDEX|isl|", OK},
+		{"COMMIT||", OK},
+		{"QUERY|gmp|", FAIL},
+		{"QUERY|cloog|", FAIL},
+		{"QUERY|isl|", OK},
+		{"BEGIN||", OK},
+		{"INDEX|gcc|isl,missing", OK},
+		{"INDEX|keep|isl", OK},
+		{"REMOVE|isl|", OK},
+		{"VERBOSE|on|", OK},
+		{"COMMIT||", "FAIL|MISSING_DEPENDENCIES|missing"},
+		{"QUERY|gcc|", FAIL},
+		{"DEPS|keep|", "OK|"},
+		{"QUERY|isl|", OK},
+		{"BEGIN||", OK},
+		{"REMOVE|isl|", OK},
+		{"ROLLBACK||", OK},
+		{"QUERY|isl|", OK},
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to establish connection to repo server")
+	}
+	defer c.Close()
+
+	reader := bufio.NewReader(c)
+	for _, command := range commands {
+		fmt.Fprintln(c, command.rawCommand)
+
+		c.SetReadDeadline(time.Now().Add(time.Second * 3))
+		response, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if response != command.expectedReturnValue+"\n" {
+			t.Errorf("Command:%s Expected:%s Got:%s", command.rawCommand, command.expectedReturnValue, response)
+		}
+	}
+}
+
+//Graph whose committed batches can't be kept
+type failingBatcher struct {
+	*graph.TreeGraph
+	flushed []bool
+}
+
+func (b *failingBatcher) Batch() {}
+
+func (b *failingBatcher) Flush(committed bool) error {
+	b.flushed = append(b.flushed, committed)
+	if committed {
+		return errors.New("Flush failed")
+	}
+	return nil
+}
+
+func TestTransactionFlushFailure(t *testing.T) {
+
+	g, _ := graph.NewGraph()
+	backend := &failingBatcher{TreeGraph: g}
+	addr, closeListener := serveRepo(NewRepo(backend), t)
+	defer closeListener()
+
+	var commands = []struct {
+		rawCommand          string
+		expectedReturnValue string
+	}{
+		{"VERBOSE|on|", OK},
+		{"BEGIN||", OK},
+		{"INDEX|gmp|missing", OK},
+		{"COMMIT||", "FAIL|MISSING_DEPENDENCIES|missing"},
+		{"BEGIN||", OK},
+		{"INDEX|gmp|", OK},
+		{"COMMIT||", "FAIL|BACKEND_ERROR|"},
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to establish connection to repo server")
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(c)
+
+	for _, command := range commands {
+		fmt.Fprintln(c, command.rawCommand)
+
+		line, err := reader.ReadString('\n')
+		if err != nil || line != command.expectedReturnValue+"\n" {
+			t.Errorf("Command:%s Expected:%s Got:%q %v", command.rawCommand, command.expectedReturnValue, line, err)
+		}
+	}
+
+	if fmt.Sprint(backend.flushed) != "[false true]" {
+		t.Errorf("Flushed:%v, expected:[false true]", backend.flushed)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+
+	g, _ := graph.NewGraph()
+	handler := NewHTTPHandler(NewRepo(g))
+
+	var requests = []struct {
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"GET", "/packages/gmp", "", http.StatusNotFound, `{"name":"gmp","status":"FAIL"}`},
+		{"PUT", "/packages/gmp", "", http.StatusOK, `{"name":"gmp","status":"OK"}`},
+		{"PUT", "/packages/isl", `{"dependencies":["gmp"]}`, http.StatusOK, `{"name":"isl","status":"OK"}`},
+		{"PUT", "/packages/cloog", `{"dependencies":["gmp","isl","ppl"]}`, http.StatusConflict, `{"name":"cloog","status":"FAIL","reason":"MISSING_DEPENDENCIES","packages":["ppl"]}`},
+		{"PUT", "/packages/cloog", `{"dependencies":["gmp","isl"]}`, http.StatusOK, `{"name":"cloog","status":"OK"}`},
+		{"PUT", "/packages/cloog", `{"dependencies":`, http.StatusBadRequest, `{"name":"cloog","status":"ERROR"}`},
+		{"PUT", "/packages/emacs=elisp", "", http.StatusBadRequest, `{"name":"emacs=elisp","status":"ERROR"}`},
+		{"GET", "/packages/cloog", "", http.StatusOK, `{"name":"cloog","status":"OK"}`},
+		{"GET", "/packages/cloog/deps", "", http.StatusOK, `{"name":"cloog","status":"OK","packages":["gmp","isl"]}`},
+		{"GET", "/packages/gmp/dependents", "", http.StatusOK, `{"name":"gmp","status":"OK","packages":["cloog","isl"]}`},
+		{"GET", "/packages/gmp/dependents?transitive=true", "", http.StatusOK, `{"name":"gmp","status":"OK","packages":["cloog","isl"]}`},
+		{"GET", "/packages/cloog/order", "", http.StatusOK, `{"name":"cloog","status":"OK","packages":["gmp","isl","cloog"]}`},
+		{"GET", "/packages/ppl/deps", "", http.StatusNotFound, `{"name":"ppl","status":"FAIL"}`},
+		{"DELETE", "/packages/gmp", "", http.StatusConflict, `{"name":"gmp","status":"FAIL","reason":"HAS_DEPENDENTS","packages":["cloog","isl"]}`},
+		{"DELETE", "/packages/cloog", "", http.StatusOK, `{"name":"cloog","status":"OK"}`},
+		{"POST", "/packages/cloog", "", http.StatusMethodNotAllowed, ``},
+		{"GET", "/packages/cloog/unknown/path", "", http.StatusNotFound, "404 page not found"},
+		{"GET", "/unknown", "", http.StatusNotFound, "404 page not found"},
+	}
+
+	for _, request := range requests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(request.method, request.path, strings.NewReader(request.body)))
+
+		if recorder.Code != request.expectedStatus {
+			t.Errorf("%s %s = %d, expected:%d", request.method, request.path, recorder.Code, request.expectedStatus)
+		}
+
+		if body := strings.TrimSpace(recorder.Body.String()); body != request.expectedBody {
+			t.Errorf("%s %s = %s, expected:%s", request.method, request.path, body, request.expectedBody)
+		}
+	}
+}
+
+func TestBackendView(t *testing.T) {
+
+	g, _ := graph.NewGraph()
+	g.Add("gmp")
+	g.Add("libfoo@1.2")
+
+	var tests = []struct {
+		name        string
+		repo        *Repo
+		versions    int
+		walked      string
+		expectedErr error
+	}{
+		{"graph", NewRepo(g), 1, "gmp,libfoo@1.2", nil},
+		{"mock", NewRepo(&MockBackend{}), 0, "", ErrListUnsupported},
+	}
+
+	for _, test := range tests {
+		views := map[string]func(ctx context.Context, fn func(backend Backend) error) error{
+			"View":   test.repo.View,
+			"Update": test.repo.Update,
+		}
+
+		for view, run := range views {
+			run(context.Background(), func(backend Backend) error {
+				versioner, isVersioner := backend.(Versioner)
+				walker, isWalker := backend.(Walker)
+				if !isVersioner || !isWalker {
+					t.Fatalf("%s %s: backend should implement Versioner and Walker", test.name, view)
+				}
+
+				if versions := versioner.Versions("libfoo"); len(versions) != test.versions {
+					t.Errorf("%s %s: Versions(libfoo) = %v, expected %d", test.name, view, versions, test.versions)
+				}
+
+				var walked []string
+				err := walker.Walk(func(name string, edges []string) error {
+					walked = append(walked, name)
+					return nil
+				})
+				if err != test.expectedErr || strings.Join(walked, ",") != test.walked {
+					t.Errorf("%s %s: Walk = %v %v, expected:%s %v", test.name, view, walked, err, test.walked, test.expectedErr)
+				}
+				return nil
+			})
+		}
+	}
+}
+
+func TestHTTPLockTimeout(t *testing.T) {
+
+	g, _ := graph.NewGraph()
+	r := NewRepo(g)
+	r.SetLockTimeout(100 * time.Millisecond)
+	handler := NewHTTPHandler(r)
+
+	stalled := make(chan struct{})
+	released := make(chan struct{})
+	go r.Update(context.Background(), func(backend Backend) error {
+		close(stalled)
+		<-released
+		return nil
+	})
+	<-stalled
+
+	var requests = []struct {
+		method         string
+		path           string
+		expectedStatus int
+	}{
+		{"GET", "/packages/gmp", http.StatusServiceUnavailable},
+		{"PUT", "/packages/gmp", http.StatusServiceUnavailable},
+		{"PUT", "/packages/emacs=elisp", http.StatusBadRequest},
+	}
+
+	for _, request := range requests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(request.method, request.path, nil))
+
+		if recorder.Code != request.expectedStatus {
+			t.Errorf("%s %s = %d, expected:%d", request.method, request.path, recorder.Code, request.expectedStatus)
+		}
+	}
+
+	close(released)
+}
+
+func TestSize(t *testing.T) {
+
+	g, _ := graph.NewGraph()
+	g.Add("gmp")
+	g.Add("isl", "gmp")
+
+	if packages, edges, ok := NewRepo(g).Size(); !ok || packages != 2 || edges != 1 {
+		t.Errorf("Size() = %d, %d, %v expected:2, 1, true", packages, edges, ok)
+	}
+
+	if _, _, ok := NewRepo(&MockBackend{}).Size(); ok {
+		t.Errorf("Size() should not be available for backends without Len and EdgeCount")
+	}
+}
@@ -0,0 +1,28 @@
+package repomanager
+
+import (
+	"crypto/x509/pkix"
+)
+
+//State negotiated by a single connection, lives for as long as Handle serves it. peer holds
+//the subject of the client certificate on mutual TLS connections, nil otherwise. watcher is
+//set once the connection has been turned into a subscription by WATCH
+type session struct {
+	verbose     bool
+	transaction *transaction
+	peer        *pkix.Name
+	watcher     *watcher
+}
+
+func newSession() *session {
+	return &session{}
+}
+
+//Replaces a FAIL caused by err with an explained one when the connection asked for it
+func (s *session) respond(output string, err error) string {
+	if s.verbose && output == FAIL && err != nil {
+		return explainFailure(err)
+	}
+
+	return output
+}
@@ -0,0 +1,377 @@
+package repomanager
+
+import (
+	"container/heap"
+	"github.com/jrxfive/packagetree/pkg/graph"
+)
+
+const (
+	BEGIN    string = "BEGIN"
+	COMMIT   string = "COMMIT"
+	ROLLBACK string = "ROLLBACK"
+
+	MAX_TRANSACTION_SIZE = 10000
+)
+
+func init() {
+	mustRegister(BEGIN, func(instruction *instruction, repo *Repo, session *session) Operation {
+		return NewBeginOperator(instruction, session)
+	})
+	mustRegister(COMMIT, func(instruction *instruction, repo *Repo, session *session) Operation {
+		return NewCommitOperator(instruction, repo, session)
+	})
+	mustRegister(ROLLBACK, func(instruction *instruction, repo *Repo, session *session) Operation {
+		return NewRollbackOperator(instruction, session)
+	})
+}
+
+//INDEX and REMOVE instructions queued by a connection between BEGIN and COMMIT
+type transaction struct {
+	instructions []*instruction
+}
+
+//Undoes a single instruction applied while committing a transaction
+type undo func(backend Backend) error
+
+//Applies every queued instruction to backend once, in the order returned by sort so
+//instructions may be queued in any order. When an instruction fails every applied one is
+//undone in reverse and its error is returned. Otherwise the instructions that changed the
+//backend are returned in the order they were applied.
+//Callers must hold the repo write lock.
+func (t *transaction) commit(backend Backend) ([]*instruction, error) {
+
+	var applied []undo
+	var changes []*instruction
+
+	for _, i := range t.sort(backend) {
+		u, changed, err := apply(backend, i)
+		if err != nil {
+			for idx := len(applied) - 1; idx >= 0; idx-- {
+				err := applied[idx](backend)
+				if err != nil {
+					logger.Printf("Failed to undo transaction instruction:%v\n", err)
+				}
+			}
+			return nil, err
+		}
+
+		applied = append(applied, u)
+		if changed {
+			changes = append(changes, i)
+		}
+	}
+
+	return changes, nil
+}
+
+//Orders the queued instructions so each comes after the ones it relies on: an INDEX after
+//the INDEX of every queued package its dependencies can resolve to, a REMOVE after the
+//instructions removing or re-indexing the package's current dependents without it, and
+//instructions for the same package in the order queued. Ties keep the queued order.
+//Instructions waiting on each other in a cycle are taken in the order queued, applying them
+//then fails.
+func (t *transaction) sort(backend Backend) []*instruction {
+
+	count := len(t.instructions)
+	byPackage := make(map[string][]int)
+	versions := make(map[string][]int)
+
+	for idx, i := range t.instructions {
+		byPackage[i.packageName] = append(byPackage[i.packageName], idx)
+		if i.cmd == INDEX {
+			base, _ := graph.SplitVersion(i.packageName)
+			versions[base] = append(versions[base], idx)
+		}
+	}
+
+	//waiting[i] lists the instructions taken after instruction i, pending[i] how many
+	//instruction i is still waiting on
+	waiting := make([][]int, count)
+	pending := make([]int, count)
+	after := func(before, idx int) {
+		waiting[before] = append(waiting[before], idx)
+		pending[idx]++
+	}
+
+	for _, queued := range byPackage {
+		for idx := 1; idx < len(queued); idx++ {
+			after(queued[idx-1], queued[idx])
+		}
+	}
+
+	for idx, i := range t.instructions {
+		switch i.cmd {
+		case INDEX:
+			for _, spec := range i.packageDependencies {
+				dependency, err := graph.ParseDependency(spec)
+				if err != nil {
+					continue
+				}
+				for _, candidate := range versions[dependency.Name] {
+					if candidate != idx && resolvesTo(dependency, t.instructions[candidate].packageName) {
+						after(candidate, idx)
+					}
+				}
+			}
+		case REMOVE:
+			dependents, _ := backend.Dependents(i.packageName)
+			for _, dependent := range dependents {
+				for _, candidate := range byPackage[dependent] {
+					c := t.instructions[candidate]
+					if c.cmd == REMOVE || !dependsOn(c, i.packageName) {
+						after(candidate, idx)
+					}
+				}
+			}
+		}
+	}
+
+	sorted := make([]*instruction, 0, count)
+	taken := make([]bool, count)
+	ready := &instructionQueue{}
+	for idx := range t.instructions {
+		if pending[idx] == 0 {
+			heap.Push(ready, idx)
+		}
+	}
+
+	for next := 0; len(sorted) < count; {
+		if ready.Len() == 0 {
+			for taken[next] {
+				next++
+			}
+			heap.Push(ready, next)
+		}
+
+		idx := heap.Pop(ready).(int)
+		if taken[idx] {
+			continue
+		}
+		taken[idx] = true
+		sorted = append(sorted, t.instructions[idx])
+
+		for _, waiter := range waiting[idx] {
+			pending[waiter]--
+			if pending[waiter] == 0 && !taken[waiter] {
+				heap.Push(ready, waiter)
+			}
+		}
+	}
+
+	return sorted
+}
+
+//Reports whether indexing i leaves it depending on name
+func dependsOn(i *instruction, name string) bool {
+	for _, spec := range i.packageDependencies {
+		dependency, err := graph.ParseDependency(spec)
+		if err == nil && resolvesTo(dependency, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func resolvesTo(dependency *graph.Dependency, name string) bool {
+	base, version := graph.SplitVersion(name)
+	return dependency.Name == base && dependency.Matches(version)
+}
+
+//Indexes of the instructions ready to be taken, lowest first so ties keep the queued order
+type instructionQueue []int
+
+func (q instructionQueue) Len() int           { return len(q) }
+func (q instructionQueue) Less(i, j int) bool { return q[i] < q[j] }
+func (q instructionQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *instructionQueue) Push(x interface{}) {
+	*q = append(*q, x.(int))
+}
+
+func (q *instructionQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+//Runs an INDEX or REMOVE instruction against backend returning how to undo it and whether
+//it changed anything, removing a package that doesn't exist changes nothing
+func apply(backend Backend, i *instruction) (undo, bool, error) {
+
+	existed := backend.Exists(i.packageName)
+
+	var previous []string
+	if existed {
+		previous, _ = backend.Dependencies(i.packageName)
+	}
+
+	restore := func(backend Backend) error {
+		if existed {
+			return backend.Add(i.packageName, previous...)
+		}
+		return backend.Remove(i.packageName)
+	}
+
+	var err error
+	switch i.cmd {
+	case INDEX:
+		err = backend.Add(i.packageName, i.packageDependencies...)
+	case REMOVE:
+		err = checkRemove(backend, i.packageName)
+		if err == nil {
+			err = backend.Remove(i.packageName)
+		}
+	}
+
+	return restore, i.cmd == INDEX || existed, err
+}
+
+//Starts queueing INDEX and REMOVE instructions on the connection until COMMIT or ROLLBACK
+type BeginOperator struct {
+	instruction *instruction
+	session     *session
+}
+
+func NewBeginOperator(instruction *instruction, session *session) *BeginOperator {
+	return &BeginOperator{
+		instruction: instruction,
+		session:     session,
+	}
+}
+
+func (o BeginOperator) Run(backend Backend) (string, error) {
+
+	if o.session.transaction != nil {
+		return ERROR, nil
+	}
+
+	o.session.transaction = &transaction{}
+	return OK, nil
+}
+
+func (o BeginOperator) Access() Access {
+	return ACCESS_NONE
+}
+
+func (o BeginOperator) GetCommand() string {
+	return o.instruction.cmd
+}
+
+//Applies every queued instruction holding the write lock, either all of them are
+//applied and OK is returned or none are and FAIL is returned
+type CommitOperator struct {
+	instruction *instruction
+	repo        *Repo
+	session     *session
+}
+
+func NewCommitOperator(instruction *instruction, repo *Repo, session *session) *CommitOperator {
+	return &CommitOperator{
+		instruction: instruction,
+		repo:        repo,
+		session:     session,
+	}
+}
+
+func (o CommitOperator) Run(backend Backend) (string, error) {
+
+	t := o.session.transaction
+	if t == nil {
+		return ERROR, nil
+	}
+	o.session.transaction = nil
+
+	batcher, batching := backend.(Batcher)
+	if batching {
+		batcher.Batch()
+	}
+
+	changes, err := t.commit(backend)
+	if batching {
+		flushErr := batcher.Flush(err == nil)
+		if err == nil && flushErr != nil {
+			changes, err = nil, flushErr
+		}
+	}
+
+	for _, i := range changes {
+		o.repo.watchers.publish(i)
+	}
+
+	if err != nil {
+		return FAIL, err
+	}
+	return OK, nil
+}
+
+func (o CommitOperator) Access() Access {
+	return ACCESS_WRITE
+}
+
+func (o CommitOperator) GetCommand() string {
+	return o.instruction.cmd
+}
+
+//Discards every queued instruction
+type RollbackOperator struct {
+	instruction *instruction
+	session     *session
+}
+
+func NewRollbackOperator(instruction *instruction, session *session) *RollbackOperator {
+	return &RollbackOperator{
+		instruction: instruction,
+		session:     session,
+	}
+}
+
+func (o RollbackOperator) Run(backend Backend) (string, error) {
+
+	if o.session.transaction == nil {
+		return ERROR, nil
+	}
+
+	o.session.transaction = nil
+	return OK, nil
+}
+
+func (o RollbackOperator) Access() Access {
+	return ACCESS_NONE
+}
+
+func (o RollbackOperator) GetCommand() string {
+	return o.instruction.cmd
+}
+
+//Queues an INDEX or REMOVE instruction on the open transaction instead of running it
+type QueueOperator struct {
+	instruction *instruction
+	session     *session
+}
+
+func NewQueueOperator(instruction *instruction, session *session) *QueueOperator {
+	return &QueueOperator{
+		instruction: instruction,
+		session:     session,
+	}
+}
+
+func (o QueueOperator) Run(backend Backend) (string, error) {
+
+	t := o.session.transaction
+	if len(t.instructions) >= MAX_TRANSACTION_SIZE {
+		return ERROR, nil
+	}
+
+	t.instructions = append(t.instructions, o.instruction)
+	return OK, nil
+}
+
+func (o QueueOperator) Access() Access {
+	return ACCESS_NONE
+}
+
+func (o QueueOperator) GetCommand() string {
+	return o.instruction.cmd
+}
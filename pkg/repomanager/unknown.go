@@ -12,10 +12,14 @@ func NewUnknownOperator() *UnknownOperator {
 	}
 }
 
-func (o UnknownOperator) Run() (string, error) {
+func (o UnknownOperator) Run(backend Backend) (string, error) {
 	return ERROR, nil
 }
 
+func (o UnknownOperator) Access() Access {
+	return ACCESS_NONE
+}
+
 func (o UnknownOperator) GetCommand() string {
 	return o.instruction.cmd
 }
@@ -0,0 +1,83 @@
+package repomanager
+
+import (
+	"github.com/jrxfive/packagetree/pkg/graph"
+	"strings"
+)
+
+const (
+	VERBOSE     string = "VERBOSE"
+	VERBOSE_ON  string = "on"
+	VERBOSE_OFF string = "off"
+)
+
+//Reason codes sent after FAIL when a connection has enabled verbose responses
+const (
+	MISSING_DEPENDENCIES string = "MISSING_DEPENDENCIES"
+	HAS_DEPENDENTS       string = "HAS_DEPENDENTS"
+	CYCLE                string = "CYCLE"
+	READ_ONLY            string = "READ_ONLY"
+	AMBIGUOUS_NAME       string = "AMBIGUOUS_NAME"
+	BACKEND_ERROR        string = "BACKEND_ERROR"
+)
+
+func init() {
+	mustRegister(VERBOSE, func(instruction *instruction, repo *Repo, session *session) Operation {
+		return NewVerboseOperator(instruction, session)
+	}, ValidPackage, ValidDependencies, ruleFor(func(request *Request) bool {
+		return validateVerboseOption(request.Package)
+	}))
+}
+
+//Toggles verbose responses for the connection it was received on, VERBOSE|on| makes
+//FAIL carry a reason code and the packages involved, VERBOSE|off| restores plain FAIL
+type VerboseOperator struct {
+	instruction *instruction
+	session     *session
+}
+
+func NewVerboseOperator(instruction *instruction, session *session) *VerboseOperator {
+	return &VerboseOperator{
+		instruction: instruction,
+		session:     session,
+	}
+}
+
+func (o VerboseOperator) Run(backend Backend) (string, error) {
+	o.session.verbose = o.instruction.packageName == VERBOSE_ON
+	return OK, nil
+}
+
+func (o VerboseOperator) Access() Access {
+	return ACCESS_NONE
+}
+
+func (o VerboseOperator) GetCommand() string {
+	return o.instruction.cmd
+}
+
+func validateVerboseOption(option string) bool {
+	return option == VERBOSE_ON || option == VERBOSE_OFF
+}
+
+//Builds a FAIL response with a reason code from the error returned by the backend, e.g.
+//FAIL|MISSING_DEPENDENCIES|gmp,isl, FAIL|HAS_DEPENDENTS|cloog, FAIL|CYCLE|gmp,isl,gmp,
+//FAIL|AMBIGUOUS_NAME|openssl@1.1,openssl@3 or FAIL|READ_ONLY|leader:8080 when the repo is a
+//replica
+func explainFailure(err error) string {
+
+	switch e := err.(type) {
+	case *graph.MissingDependenciesError:
+		return strings.Join([]string{FAIL, MISSING_DEPENDENCIES, strings.Join(e.Missing, ",")}, "|")
+	case *graph.DependentsExistError:
+		return strings.Join([]string{FAIL, HAS_DEPENDENTS, strings.Join(e.Dependents, ",")}, "|")
+	case *graph.CycleError:
+		return strings.Join([]string{FAIL, CYCLE, strings.Join(e.Cycle, ",")}, "|")
+	case *ReadOnlyError:
+		return strings.Join([]string{FAIL, READ_ONLY, e.Leader}, "|")
+	case *AmbiguousNameError:
+		return strings.Join([]string{FAIL, AMBIGUOUS_NAME, strings.Join(e.Versions, ",")}, "|")
+	default:
+		return strings.Join([]string{FAIL, BACKEND_ERROR, ""}, "|")
+	}
+}
@@ -0,0 +1,183 @@
+package repomanager
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WATCH          string = "WATCH"
+	INDEXED        string = "INDEXED"
+	REMOVED        string = "REMOVED"
+	WATCH_OVERFLOW string = "OVERFLOW"
+
+	WATCH_BUFFER_SIZE   int           = 1024
+	WATCH_WRITE_TIMEOUT time.Duration = 10 * time.Second
+)
+
+func init() {
+	mustRegister(WATCH, func(instruction *instruction, repo *Repo, session *session) Operation {
+		return NewWatchOperator(instruction, repo, session)
+	}, ruleFor(func(request *Request) bool {
+		return validateWatchPattern(request.Package, request.Dependencies)
+	}))
+}
+
+//Events waiting to be sent to a single watcher, dropped is closed once it falls
+//WATCH_BUFFER_SIZE events behind
+type watcher struct {
+	pattern string
+	events  chan string
+	dropped chan struct{}
+}
+
+//Watchers subscribed to the repo. Publishing never blocks so a lagging watcher can't hold
+//up writers, it is dropped instead.
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+func (h *watchHub) subscribe(pattern string) *watcher {
+	w := &watcher{
+		pattern: pattern,
+		events:  make(chan string, WATCH_BUFFER_SIZE),
+		dropped: make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	h.watchers[w] = struct{}{}
+	h.mu.Unlock()
+
+	return w
+}
+
+func (h *watchHub) unsubscribe(w *watcher) {
+	h.mu.Lock()
+	delete(h.watchers, w)
+	h.mu.Unlock()
+}
+
+//Sends the event for a committed INDEX or REMOVE to every watcher whose pattern matches the
+//package, callers hold the repo write lock so events are seen in the order committed
+func (h *watchHub) publish(i *instruction) {
+
+	event := REMOVED + "|" + i.packageName + "|"
+	if i.cmd == INDEX {
+		event = INDEXED + "|" + i.packageName + "|" + strings.Join(i.packageDependencies, ",")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.watchers {
+		if matched, _ := path.Match(w.pattern, i.packageName); !matched {
+			continue
+		}
+
+		select {
+		case w.events <- event:
+		default:
+			delete(h.watchers, w)
+			close(w.dropped)
+		}
+	}
+}
+
+//Turns the connection into a subscription, WATCH|pattern| answers OK and then sends
+//INDEXED|name|deps and REMOVED|name| for every committed change to a package matching
+//pattern, using path.Match syntax e.g. lib*. Messages sent afterwards are ignored. A watcher
+//that falls WATCH_BUFFER_SIZE events behind is sent OVERFLOW and disconnected.
+type WatchOperator struct {
+	instruction *instruction
+	repo        *Repo
+	session     *session
+}
+
+func NewWatchOperator(instruction *instruction, repo *Repo, session *session) *WatchOperator {
+	return &WatchOperator{
+		instruction: instruction,
+		repo:        repo,
+		session:     session,
+	}
+}
+
+func (o WatchOperator) Run(backend Backend) (string, error) {
+
+	if o.session.transaction != nil || o.session.watcher != nil {
+		return ERROR, nil
+	}
+
+	o.session.watcher = o.repo.watchers.subscribe(o.instruction.packageName)
+	return OK, nil
+}
+
+func (o WatchOperator) Access() Access {
+	return ACCESS_NONE
+}
+
+func (o WatchOperator) GetCommand() string {
+	return o.instruction.cmd
+}
+
+func validateWatchPattern(pattern string, options []string) bool {
+	if pattern == "" || len(options) > 0 {
+		return false
+	}
+
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
+
+//Sends w's events on conn, encoded by encode, until the client goes away, the connection is
+//drained or w is dropped
+func (r *Repo) watch(conn net.Conn, reader io.Reader, writer *bufio.Writer, w *watcher, encode func(event string) []byte) {
+
+	conn.SetReadDeadline(time.Time{})
+
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, reader)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case event := <-w.events:
+			//The deadline left over from the last batch, or the session's idle timeout, may
+			//have passed while the watcher was quiet. Writes larger than the buffer go out
+			//before Flush so it's refreshed ahead of the whole batch.
+			conn.SetWriteDeadline(time.Now().Add(WATCH_WRITE_TIMEOUT))
+			_, err := writer.Write(encode(event))
+			for err == nil && len(w.events) > 0 {
+				_, err = writer.Write(encode(<-w.events))
+			}
+			if err == nil {
+				err = writer.Flush()
+			}
+			if err != nil {
+				return
+			}
+		case <-w.dropped:
+			logger.Printf("Watcher %v fell more than %d events behind disconnecting\n", conn.RemoteAddr(), WATCH_BUFFER_SIZE)
+			conn.SetWriteDeadline(time.Now().Add(WATCH_WRITE_TIMEOUT))
+			writer.Write(encode(WATCH_OVERFLOW))
+			writer.Flush()
+			return
+		case <-closed:
+			return
+		}
+	}
+}
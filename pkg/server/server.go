@@ -1,17 +1,37 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
 	"github.com/jrxfive/packagetree/pkg/logging"
+	"github.com/jrxfive/packagetree/pkg/metrics"
+	"io"
+	"io/ioutil"
 	"net"
-	"os"
-	"os/signal"
 	"sync"
-	"syscall"
 	"time"
 )
 
+const (
+	DEFAULT_DRAIN_TIMEOUT     time.Duration = 10 * time.Second
+	DEFAULT_DRAIN_NOTICE      string        = "SHUTDOWN"
+	DEFAULT_LIFETIME_NOTICE   string        = "EXPIRED"
+	DEFAULT_HERD_WAIT_TIMEOUT time.Duration = 5 * time.Second
+	DEFAULT_HANDSHAKE_TIMEOUT time.Duration = 10 * time.Second
+	DEFAULT_BUSY_NOTICE       string        = "BUSY"
+	HERD_POLICY_QUEUE         string        = "queue"
+	HERD_POLICY_REJECT        string        = "reject"
+	MIN_ACCEPT_DELAY          time.Duration = 5 * time.Millisecond
+	MAX_ACCEPT_DELAY          time.Duration = time.Second
+)
+
 var logger = logging.GetLogger()
+var activeConnections = metrics.NewGauge("packagetree_active_connections", "Connections currently being handled.")
+var rejectedConnectionsTotal = metrics.NewCounterVec("packagetree_rejected_connections_total", "Connections turned away because MaxHerd connections were already being handled.", "policy")
 
 type ConnectionHandler interface {
 	Handle(conn net.Conn)
@@ -21,86 +41,584 @@ type Configuration struct {
 	Handler           ConnectionHandler
 	Port              int
 	MaxHerd           int
-	Timeout           time.Duration
+	HerdPolicy        string
+	HerdWaitTimeout   time.Duration
+	BusyNotice        string
+	CertFile          string
+	KeyFile           string
+	ClientCAFile      string
+	HandshakeTimeout  time.Duration
+	MaxLifetime       time.Duration
+	LifetimeNotice    string
+	DrainTimeout      time.Duration
+	DrainNotice       string
 	ConnectionChannel chan net.Conn
-	SignalChannel     chan os.Signal
-	mu                sync.RWMutex
 }
 
-//Creates and returns a new configuration that can has a net.Conn Handler. The
-//port to bind the TCP server to, how large the buffer should be for simultaneous connections
-//to the connection channel.
-func NewServerConfiguration(handler ConnectionHandler, port, maxHerd, timeout int) *Configuration {
+//Creates and returns a new configuration serving handler on port. At most maxHerd connections
+//are handled at once, a maxHerd below 1 handles every connection. Once maxHerd connections are
+//active new ones are queued for up to DEFAULT_HERD_WAIT_TIMEOUT each, set HerdPolicy to
+//HERD_POLICY_REJECT to turn them away straight away. Connections that can't be handled are
+//sent DEFAULT_BUSY_NOTICE and closed. Setting CertFile and KeyFile serves TLS, adding
+//ClientCAFile also requires clients to present a certificate signed by one of its CAs. Active
+//connections are given DEFAULT_DRAIN_TIMEOUT to finish when the server stops and are sent
+//DEFAULT_DRAIN_NOTICE before being closed. Sessions have no maximum lifetime unless
+//MaxLifetime is set, idle connections are left to the handler to time out.
+func NewServerConfiguration(handler ConnectionHandler, port, maxHerd int) *Configuration {
 
-	signalChannel := make(chan os.Signal, 1)
-	connChannel := make(chan net.Conn, maxHerd)
+	buffer := maxHerd
+	if buffer < 0 {
+		buffer = 0
+	}
+	connChannel := make(chan net.Conn, buffer)
 
 	return &Configuration{
 		Handler:           handler,
 		Port:              port,
-		Timeout:           time.Duration(timeout),
+		HerdPolicy:        HERD_POLICY_QUEUE,
+		HerdWaitTimeout:   DEFAULT_HERD_WAIT_TIMEOUT,
+		BusyNotice:        DEFAULT_BUSY_NOTICE,
+		HandshakeTimeout:  DEFAULT_HANDSHAKE_TIMEOUT,
+		LifetimeNotice:    DEFAULT_LIFETIME_NOTICE,
+		DrainTimeout:      DEFAULT_DRAIN_TIMEOUT,
+		DrainNotice:       DEFAULT_DRAIN_NOTICE,
 		MaxHerd:           maxHerd,
 		ConnectionChannel: connChannel,
-		SignalChannel:     signalChannel,
-		mu:                sync.RWMutex{},
 	}
 }
 
-//Binds a TCP server to handle connections for anything that use the interface ConnectionHandler. Will
-//close the server and channel on SIGINT or SIGTERM.
-func Listen(sc *Configuration) error {
+//TCP server handing every accepted connection to the configured ConnectionHandler. It
+//installs no signal handlers, callers stop it by cancelling the context given to Serve or by
+//calling Shutdown.
+type Server struct {
+	configuration *Configuration
+	listener      net.Listener
+	tracker       *connectionTracker
+	slots         chan struct{}
+	shutdown      chan struct{}
+	drained       chan struct{}
+	stopOnce      sync.Once
+	drainedOnce   sync.Once
+}
+
+//Binds the TCP listener described by sc. Binding port 0 picks a free port, Addr reports
+//the one chosen.
+func NewServer(sc *Configuration) (*Server, error) {
 
-	signal.Notify(sc.SignalChannel, syscall.SIGINT, syscall.SIGTERM)
-	channelBreaker := false
+	tlsConfig, err := newTLSConfig(sc)
+	if err != nil {
+		return nil, err
+	}
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", sc.Port))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	go func(listener net.Listener, connChannel chan net.Conn, signalChannel chan os.Signal) {
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	var slots chan struct{}
+	if sc.MaxHerd > 0 {
+		slots = make(chan struct{}, sc.MaxHerd)
+	}
+
+	return &Server{
+		configuration: sc,
+		listener:      listener,
+		tracker:       newConnectionTracker(sc.DrainNotice, sc.HandshakeTimeout),
+		slots:         slots,
+		shutdown:      make(chan struct{}),
+		drained:       make(chan struct{}),
+	}, nil
+}
+
+//Builds the TLS configuration described by sc, nil when sc has no certificate
+func newTLSConfig(sc *Configuration) (*tls.Config, error) {
+
+	if sc.CertFile == "" && sc.KeyFile == "" {
+		if sc.ClientCAFile != "" {
+			return nil, errors.New("Client CA requires a certificate and key")
+		}
+		return nil, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(sc.CertFile, sc.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if sc.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(sc.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in client CA file:%v", sc.ClientCAFile)
+		}
+
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+//Returns the subject of the certificate the client presented on conn, ok is false for
+//plaintext connections and TLS clients that didn't present one
+func PeerSubject(conn net.Conn) (subject pkix.Name, ok bool) {
+
+	if tc, isTracked := conn.(*trackedConn); isTracked {
+		conn = tc.Conn
+	}
+
+	tlsConn, isTLS := conn.(*tls.Conn)
+	if !isTLS {
+		return subject, false
+	}
+
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return subject, false
+	}
+
+	return certificates[0].Subject, true
+}
+
+//Returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+//Accepts connections until ctx is done, Shutdown is called or the connection channel is
+//closed. Active connections are then drained: each is allowed to finish the command it is
+//running, is sent the drain notice and closed. Connections still open after the drain
+//timeout are closed forcibly. Serve returns once every connection has been drained.
+//Temporary accept errors such as running out of file descriptors are retried after a delay,
+//starting at MIN_ACCEPT_DELAY and doubling up to MAX_ACCEPT_DELAY, any other stops the server.
+func (s *Server) Serve(ctx context.Context) error {
+
+	sc := s.configuration
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			drainCtx, cancel := context.WithTimeout(context.Background(), sc.DrainTimeout)
+			s.Shutdown(drainCtx)
+			cancel()
+		case <-s.shutdown:
+		}
+	}()
+
+	go func(connChannel chan net.Conn) {
 
 		for {
 			select {
-			case s := <-signalChannel:
-				logger.Printf("Signal:%v received closing channel and listener\n", s)
-				close(connChannel)
-				listener.Close()
+			case <-s.shutdown:
+				return
 			case conn, ok := <-connChannel:
-				if ok {
-					err = conn.SetDeadline(time.Now().Add(time.Second * sc.Timeout))
-					if err != nil {
-						conn.Close()
-					} else {
-						go sc.Handler.Handle(conn)
-					}
-				} else {
-					sc.mu.Lock()
-					channelBreaker = true
-					sc.mu.Unlock()
+				if !ok {
+					s.stop()
+					return
 				}
+
+				s.dispatch(conn)
 			}
 		}
 
-	}(listener, sc.ConnectionChannel, sc.SignalChannel)
+	}(sc.ConnectionChannel)
 
+	var err error
+	var delay time.Duration
 	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			sc.mu.RLock()
-			if channelBreaker {
-				sc.mu.RUnlock()
-				break
+		var conn net.Conn
+		conn, err = s.listener.Accept()
+		if e, ok := err.(net.Error); ok && e.Temporary() {
+			delay = nextAcceptDelay(delay)
+			logger.Printf("Failed to accept connection:%v retrying in %v\n", err, delay)
+			if s.sleep(delay) {
+				continue
 			}
-			sc.mu.RUnlock()
+			break
 		}
+		if err != nil {
+			break
+		}
+		delay = 0
 
-		sc.mu.RLock()
-		if !channelBreaker {
-			sc.ConnectionChannel <- conn
+		select {
+		case sc.ConnectionChannel <- conn:
+		case <-s.shutdown:
+			conn.Close()
 		}
-		sc.mu.RUnlock()
 	}
 
+	select {
+	case <-s.shutdown:
+	default:
+		logger.Printf("Failed to accept connection:%v\n", err)
+		drainCtx, cancel := context.WithTimeout(context.Background(), sc.DrainTimeout)
+		s.Shutdown(drainCtx)
+		cancel()
+		return err
+	}
+
+	<-s.drained
 	return nil
 }
+
+//Waits for d, returning false early when the server is shut down meanwhile
+func (s *Server) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-s.shutdown:
+		return false
+	}
+}
+
+func nextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return MIN_ACCEPT_DELAY
+	}
+	if delay*2 > MAX_ACCEPT_DELAY {
+		return MAX_ACCEPT_DELAY
+	}
+	return delay * 2
+}
+
+//Stops accepting connections and drains the active ones, returning once they have all
+//finished. When ctx is done first the remaining connections are closed and ctx's error is
+//returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+
+	s.stop()
+	closePending(s.configuration.ConnectionChannel)
+
+	err := s.tracker.drain(ctx)
+	s.drainedOnce.Do(func() {
+		close(s.drained)
+	})
+
+	return err
+}
+
+//Hands conn to the handler once it holds one of the MaxHerd slots. Connections that can't
+//take one straight away wait for it, or are rejected, on their own goroutine so a slow client
+//never holds up the connections behind it. Each queued connection gets the full
+//HerdWaitTimeout however many are queued ahead of it.
+func (s *Server) dispatch(conn net.Conn) {
+
+	if s.slots == nil {
+		s.serve(conn)
+		return
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		s.serve(conn)
+		return
+	default:
+	}
+
+	if s.configuration.HerdPolicy == HERD_POLICY_REJECT {
+		go s.reject(conn)
+		return
+	}
+
+	go s.wait(conn)
+}
+
+//Waits up to HerdWaitTimeout for a slot to free up, connections that don't get one are
+//rejected
+func (s *Server) wait(conn net.Conn) {
+
+	var timeout <-chan time.Time
+	if s.configuration.HerdWaitTimeout > 0 {
+		timer := time.NewTimer(s.configuration.HerdWaitTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		s.serve(conn)
+	case <-s.shutdown:
+		conn.Close()
+	case <-timeout:
+		s.reject(conn)
+	}
+}
+
+//Sends conn the busy notice and closes it. TLS connections are handshaken first, writing the
+//notice would otherwise start the handshake without a deadline. Rejected clients are never
+//waited on indefinitely, a HandshakeTimeout of 0 falls back to DEFAULT_HANDSHAKE_TIMEOUT.
+func (s *Server) reject(conn net.Conn) {
+
+	sc := s.configuration
+
+	logger.Printf("Connection limit of %d reached rejecting %v\n", sc.MaxHerd, conn.RemoteAddr())
+	rejectedConnectionsTotal.Inc(sc.HerdPolicy)
+
+	timeout := sc.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DEFAULT_HANDSHAKE_TIMEOUT
+	}
+
+	if sc.BusyNotice != "" && handshake(conn, timeout) == nil {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		fmt.Fprintln(conn, sc.BusyNotice)
+	}
+	conn.Close()
+}
+
+func (s *Server) serve(conn net.Conn) {
+	sc := s.configuration
+	s.tracker.serve(sc.Handler, conn, sc.MaxLifetime, sc.LifetimeNotice, s.release)
+}
+
+//Frees the slot taken by dispatch once a connection is done
+func (s *Server) release() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+func (s *Server) stop() {
+	s.stopOnce.Do(func() {
+		close(s.shutdown)
+		s.listener.Close()
+	})
+}
+
+//Binds and serves sc until the connection channel is closed. Kept for callers that don't
+//need to stop the server, use NewServer to control its lifetime.
+func Listen(sc *Configuration) error {
+
+	s, err := NewServer(sc)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(context.Background())
+}
+
+//Closes connections that were accepted but never handed to the handler
+func closePending(connChannel chan net.Conn) {
+	for {
+		select {
+		case conn, ok := <-connChannel:
+			if !ok {
+				return
+			}
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+//Runs the handler against conn while counting it as an active connection
+func handle(handler ConnectionHandler, conn net.Conn) {
+	activeConnections.Inc()
+	defer activeConnections.Dec()
+
+	handler.Handle(conn)
+}
+
+//Completes the TLS handshake on conn within timeout so handlers see the peer's certificate
+//from the start, plaintext connections are left untouched
+func handshake(conn net.Conn, timeout time.Duration) error {
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		defer tlsConn.SetDeadline(time.Time{})
+	}
+
+	return tlsConn.Handshake()
+}
+
+//Keeps track of the connections being handled so they can be drained on shutdown
+type connectionTracker struct {
+	mu               sync.Mutex
+	wg               sync.WaitGroup
+	conns            map[*trackedConn]struct{}
+	notice           string
+	handshakeTimeout time.Duration
+	draining         bool
+}
+
+func newConnectionTracker(notice string, handshakeTimeout time.Duration) *connectionTracker {
+	return &connectionTracker{
+		conns:            make(map[*trackedConn]struct{}),
+		notice:           notice,
+		handshakeTimeout: handshakeTimeout,
+	}
+}
+
+//Hands conn to handler on its own go routine, the connection is closed and done is called once
+//the handler returns. A lifetime above zero drains the connection with lifetimeNotice once it
+//has been open that long
+func (t *connectionTracker) serve(handler ConnectionHandler, conn net.Conn, lifetime time.Duration, lifetimeNotice string, done func()) {
+
+	tc := &trackedConn{Conn: conn}
+
+	t.mu.Lock()
+	if t.draining {
+		t.mu.Unlock()
+		conn.Close()
+		done()
+		return
+	}
+	t.conns[tc] = struct{}{}
+	t.wg.Add(1)
+	t.mu.Unlock()
+
+	var timer *time.Timer
+	if lifetime > 0 {
+		timer = time.AfterFunc(lifetime, func() {
+			tc.drain(lifetimeNotice)
+		})
+	}
+
+	go func() {
+		defer t.wg.Done()
+
+		err := handshake(conn, t.handshakeTimeout)
+		if err != nil {
+			logger.Printf("TLS handshake with %v failed:%v\n", conn.RemoteAddr(), err)
+		} else {
+			handle(handler, tc)
+		}
+		tc.Close()
+		if timer != nil {
+			timer.Stop()
+		}
+
+		t.mu.Lock()
+		delete(t.conns, tc)
+		t.mu.Unlock()
+		done()
+	}()
+}
+
+//Asks every connection to finish and waits until their handlers return or ctx is done,
+//connections still open by then are closed and ctx's error is returned
+func (t *connectionTracker) drain(ctx context.Context) error {
+
+	t.mu.Lock()
+	t.draining = true
+	for tc := range t.conns {
+		tc.drain(t.notice)
+	}
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		t.mu.Lock()
+		logger.Printf("Drain timeout reached closing %d connections\n", len(t.conns))
+		for tc := range t.conns {
+			tc.Close()
+		}
+		t.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+//Connection that stops reading once drained. The read that follows the command being run
+//sends the drain notice and reports io.EOF so the handler returns after its response.
+type trackedConn struct {
+	net.Conn
+	notice   string
+	mu       sync.Mutex
+	draining bool
+	noticed  bool
+}
+
+//Interrupts any read in progress and makes every following read end the connection after
+//sending notice, a connection that is already draining keeps its first notice
+func (c *trackedConn) drain(notice string) {
+	c.mu.Lock()
+	if !c.draining {
+		c.draining = true
+		c.notice = notice
+	}
+	c.Conn.SetReadDeadline(time.Now())
+	c.mu.Unlock()
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+
+	if c.finishDrain() {
+		return 0, io.EOF
+	}
+
+	n, err := c.Conn.Read(b)
+	if err != nil && c.finishDrain() {
+		return n, io.EOF
+	}
+
+	return n, err
+}
+
+//Keeps a drained connection from extending its read deadline
+func (c *trackedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.draining {
+		t = time.Now()
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *trackedConn) SetDeadline(t time.Time) error {
+	err := c.Conn.SetWriteDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	return c.SetReadDeadline(t)
+}
+
+//Sends the drain notice once when the connection is draining, reporting whether it is
+func (c *trackedConn) finishDrain() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.draining {
+		return false
+	}
+
+	if !c.noticed && c.notice != "" {
+		c.noticed = true
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		fmt.Fprintln(c.Conn, c.notice)
+	}
+
+	return true
+}
@@ -1,10 +1,22 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
-	"math/rand"
+	"io/ioutil"
+	"math/big"
+	mathrand "math/rand"
 	"net"
-	"syscall"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -17,18 +29,18 @@ func (mch *MockConnectionHandler) Handle(conn net.Conn) {
 }
 
 func random(min, max int) int {
-	rand.Seed(time.Now().Unix() + 1)
-	return rand.Intn(max-min) + min
+	mathrand.Seed(time.Now().Unix() + 1)
+	return mathrand.Intn(max-min) + min
 }
 
 func serverSetup(port int, t *testing.T) *Configuration {
 	mch := &MockConnectionHandler{}
-	configuration := NewServerConfiguration(mch, port+1, 1, 10)
+	configuration := NewServerConfiguration(mch, port+1, 1)
 
 	go func() {
 		err := Listen(configuration)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 	}()
 
@@ -37,12 +49,129 @@ func serverSetup(port int, t *testing.T) *Configuration {
 	return configuration
 }
 
-func TestListenSignal(t *testing.T) {
+func TestServeContextCancel(t *testing.T) {
 
-	port := random(1025, 9999)
-	configuration := serverSetup(port, t)
+	configuration := NewServerConfiguration(&MockConnectionHandler{}, 0, 1)
+	s, err := NewServer(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	returned := make(chan error)
+	go func() {
+		returned <- s.Serve(ctx)
+	}()
+
+	cancel()
+
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Errorf("Serve() = %v, expected nil after cancel", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Serve did not return after its context was cancelled")
+	}
+}
+
+func TestServerAddr(t *testing.T) {
+
+	s, err := NewServer(NewServerConfiguration(&MockConnectionHandler{}, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
 
-	configuration.SignalChannel <- syscall.SIGINT
+	addr, ok := s.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("Addr() = %v, expected the port chosen for port 0", s.Addr())
+	}
+
+	go s.Serve(context.Background())
+
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to establish connection to %v", s.Addr())
+	}
+	c.Close()
+}
+
+//Listener failing the first failures calls to Accept with a temporary error
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+type temporaryError struct{}
+
+func (e temporaryError) Error() string   { return "too many open files" }
+func (e temporaryError) Timeout() bool   { return false }
+func (e temporaryError) Temporary() bool { return true }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServeTemporaryAcceptError(t *testing.T) {
+
+	s, err := NewServer(NewServerConfiguration(&MockConnectionHandler{}, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listener = &flakyListener{Listener: s.listener, failures: 5}
+
+	returned := make(chan error, 1)
+	go func() {
+		returned <- s.Serve(context.Background())
+	}()
+
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to establish connection to %v", s.Addr())
+	}
+	defer c.Close()
+
+	//The handler closes the connection once it is accepted
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err = c.Read(make([]byte, 1))
+	if e, ok := err.(net.Error); err == nil || (ok && e.Timeout()) {
+		t.Errorf("Connection should be handled after temporary accept errors, got:%v", err)
+	}
+
+	select {
+	case err := <-returned:
+		t.Fatalf("Serve() = %v after a temporary accept error, expected it to keep serving", err)
+	default:
+	}
+
+	s.Shutdown(context.Background())
+	if err := <-returned; err != nil {
+		t.Errorf("Serve() = %v after Shutdown, expected:nil", err)
+	}
+}
+
+func TestNextAcceptDelay(t *testing.T) {
+
+	var tests = []struct {
+		delay    time.Duration
+		expected time.Duration
+	}{
+		{0, MIN_ACCEPT_DELAY},
+		{MIN_ACCEPT_DELAY, 2 * MIN_ACCEPT_DELAY},
+		{MAX_ACCEPT_DELAY / 2, MAX_ACCEPT_DELAY},
+		{MAX_ACCEPT_DELAY, MAX_ACCEPT_DELAY},
+	}
+
+	for _, test := range tests {
+		if delay := nextAcceptDelay(test.delay); delay != test.expected {
+			t.Errorf("nextAcceptDelay(%v) = %v, expected:%v", test.delay, delay, test.expected)
+		}
+	}
 }
 
 func TestListenClose(t *testing.T) {
@@ -85,3 +214,550 @@ func TestListenMessagesClose(t *testing.T) {
 		_, err = fmt.Fprintln(c, connection.rawCommand)
 	}
 }
+
+//Answers every line with OK after a short pause, as if each command took a while to run
+type SlowConnectionHandler struct {
+	delay time.Duration
+}
+
+func (sch *SlowConnectionHandler) Handle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		_, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		time.Sleep(sch.delay)
+		fmt.Fprintln(conn, "OK")
+	}
+}
+
+//Serves handler on a free port returning the server, its cancel function and a channel
+//closed once Serve returns
+func drainSetup(handler ConnectionHandler, drainTimeout time.Duration, t *testing.T) (*Server, context.CancelFunc, chan struct{}) {
+	configuration := NewServerConfiguration(handler, 0, 1)
+	configuration.DrainTimeout = drainTimeout
+
+	s, err := NewServer(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	returned := make(chan struct{})
+
+	go func() {
+		err := s.Serve(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		close(returned)
+	}()
+
+	return s, cancel, returned
+}
+
+func TestListenDrain(t *testing.T) {
+
+	s, cancel, returned := drainSetup(&SlowConnectionHandler{delay: 300 * time.Millisecond}, 5*time.Second, t)
+
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to establish connection to server")
+	}
+	defer c.Close()
+
+	fmt.Fprintln(c, "QUERY|boo|")
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(c)
+	for _, expected := range []string{"OK\n", DEFAULT_DRAIN_NOTICE + "\n"} {
+		line, err := reader.ReadString('\n')
+		if err != nil || line != expected {
+			t.Errorf("Expected:%q Got:%q %v", expected, line, err)
+		}
+	}
+
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Errorf("Connection should be closed after the drain notice")
+	}
+
+	select {
+	case <-returned:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Listen did not return after draining")
+	}
+
+	if _, err := net.Dial("tcp", s.Addr().String()); err == nil {
+		t.Errorf("Listener should be closed after draining")
+	}
+}
+
+func TestListenDrainTimeout(t *testing.T) {
+
+	s, cancel, returned := drainSetup(&SlowConnectionHandler{delay: 10 * time.Second}, 200*time.Millisecond, t)
+
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to establish connection to server")
+	}
+	defer c.Close()
+
+	fmt.Fprintln(c, "QUERY|boo|")
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-returned:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Listen did not return after the drain timeout")
+	}
+
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := bufio.NewReader(c).ReadString('\n'); err == nil {
+		t.Errorf("Connection should be closed once the drain timeout is reached")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+
+	s, _, returned := drainSetup(&SlowConnectionHandler{delay: 10 * time.Second}, time.Minute, t)
+
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to establish connection to server")
+	}
+	defer c.Close()
+
+	fmt.Fprintln(c, "QUERY|boo|")
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() = %v, expected:%v", err, context.DeadlineExceeded)
+	}
+
+	select {
+	case <-returned:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Serve did not return after Shutdown")
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+
+	configuration := NewServerConfiguration(&SlowConnectionHandler{}, 0, 1)
+	configuration.MaxLifetime = 300 * time.Millisecond
+
+	s, err := NewServer(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	go s.Serve(context.Background())
+
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to establish connection to server")
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(c)
+
+	fmt.Fprintln(c, "QUERY|boo|")
+	if line, err := reader.ReadString('\n'); err != nil || line != "OK\n" {
+		t.Errorf("Expected:%q Got:%q %v", "OK\n", line, err)
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil || line != DEFAULT_LIFETIME_NOTICE+"\n" {
+		t.Errorf("Expected:%q Got:%q %v", DEFAULT_LIFETIME_NOTICE+"\n", line, err)
+	}
+
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Errorf("Connection should be closed after its lifetime")
+	}
+}
+
+func TestMaxHerd(t *testing.T) {
+
+	var tests = []struct {
+		name        string
+		policy      string
+		waitTimeout time.Duration
+		expected    string
+	}{
+		{"reject", HERD_POLICY_REJECT, time.Minute, DEFAULT_BUSY_NOTICE + "\n"},
+		{"queue", HERD_POLICY_QUEUE, 3 * time.Second, "OK\n"},
+		{"queue timeout", HERD_POLICY_QUEUE, 100 * time.Millisecond, DEFAULT_BUSY_NOTICE + "\n"},
+	}
+
+	for _, test := range tests {
+		configuration := NewServerConfiguration(&SlowConnectionHandler{}, 0, 1)
+		configuration.HerdPolicy = test.policy
+		configuration.HerdWaitTimeout = test.waitTimeout
+
+		s, err := NewServer(configuration)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve(context.Background())
+
+		first, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to establish connection to server")
+		}
+		first.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+		fmt.Fprintln(first, "QUERY|boo|")
+		if line, err := bufio.NewReader(first).ReadString('\n'); err != nil || line != "OK\n" {
+			t.Errorf("%s: Expected:%q Got:%q %v", test.name, "OK\n", line, err)
+		}
+
+		second, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to establish connection to server")
+		}
+		second.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+		fmt.Fprintln(second, "QUERY|boo|")
+		time.Sleep(300 * time.Millisecond)
+		first.Close()
+
+		reader := bufio.NewReader(second)
+		line, err := reader.ReadString('\n')
+		if err != nil || line != test.expected {
+			t.Errorf("%s: Expected:%q Got:%q %v", test.name, test.expected, line, err)
+		}
+
+		if test.expected == DEFAULT_BUSY_NOTICE+"\n" {
+			if _, err := reader.ReadString('\n'); err == nil {
+				t.Errorf("%s: Connection should be closed after the busy notice", test.name)
+			}
+		}
+
+		second.Close()
+		s.Shutdown(context.Background())
+	}
+}
+
+func TestMaxHerdQueueWait(t *testing.T) {
+
+	configuration := NewServerConfiguration(&SlowConnectionHandler{}, 0, 1)
+	configuration.HerdWaitTimeout = 500 * time.Millisecond
+
+	s, err := NewServer(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
+
+	first, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to establish connection to server")
+	}
+	defer first.Close()
+
+	fmt.Fprintln(first, "QUERY|boo|")
+	if line, err := bufio.NewReader(first).ReadString('\n'); err != nil || line != "OK\n" {
+		t.Fatalf("Expected:%q Got:%q %v", "OK\n", line, err)
+	}
+
+	//Every queued connection waits out its own timeout at the same time as the others
+	queued := make(chan time.Duration, 4)
+	start := time.Now()
+	for idx := 0; idx < cap(queued); idx++ {
+		go func() {
+			conn, err := net.Dial("tcp", s.Addr().String())
+			if err != nil {
+				queued <- time.Hour
+				return
+			}
+			defer conn.Close()
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil || line != DEFAULT_BUSY_NOTICE+"\n" {
+				t.Errorf("Expected:%q Got:%q %v", DEFAULT_BUSY_NOTICE+"\n", line, err)
+			}
+			queued <- time.Since(start)
+		}()
+	}
+
+	for idx := 0; idx < cap(queued); idx++ {
+		if waited := <-queued; waited > 2*configuration.HerdWaitTimeout {
+			t.Errorf("Queued connection was rejected after %v, expected about:%v", waited, configuration.HerdWaitTimeout)
+		}
+	}
+}
+
+func TestNegativeMaxHerd(t *testing.T) {
+
+	configuration := NewServerConfiguration(&SlowConnectionHandler{}, 0, -1)
+
+	s, err := NewServer(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to establish connection to server")
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	fmt.Fprintln(c, "QUERY|boo|")
+	if line, err := bufio.NewReader(c).ReadString('\n'); err != nil || line != "OK\n" {
+		t.Errorf("Expected:%q Got:%q %v", "OK\n", line, err)
+	}
+}
+
+//Answers every connection with the common name of the client certificate, or - without one
+type PeerSubjectHandler struct {
+}
+
+func (psh *PeerSubjectHandler) Handle(conn net.Conn) {
+	defer conn.Close()
+
+	subject, ok := PeerSubject(conn)
+	if !ok {
+		fmt.Fprintln(conn, "-")
+		return
+	}
+	fmt.Fprintln(conn, subject.CommonName)
+}
+
+//Issues a certificate for commonName signed by parent, or self signed when parent is nil
+func issueCertificate(commonName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	return certificate, key, certPEM, keyPEM
+}
+
+func writeFile(dir, name string, contents []byte, t *testing.T) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, contents, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTLS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "packagetree-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey, caPEM, _ := issueCertificate("packagetree-ca", nil, nil, t)
+	_, _, serverPEM, serverKeyPEM := issueCertificate("packagetree", ca, caKey, t)
+	_, _, clientPEM, clientKeyPEM := issueCertificate("client", ca, caKey, t)
+
+	caFile := writeFile(dir, "ca.pem", caPEM, t)
+	certFile := writeFile(dir, "server.pem", serverPEM, t)
+	keyFile := writeFile(dir, "server-key.pem", serverKeyPEM, t)
+
+	clientCertificate, err := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	var tests = []struct {
+		name         string
+		clientCA     string
+		certificates []tls.Certificate
+		expected     string
+	}{
+		{"tls", "", nil, "-\n"},
+		{"tls client certificate ignored", "", []tls.Certificate{clientCertificate}, "-\n"},
+		{"mutual tls", caFile, []tls.Certificate{clientCertificate}, "client\n"},
+		{"mutual tls without certificate", caFile, nil, ""},
+	}
+
+	for _, test := range tests {
+		configuration := NewServerConfiguration(&PeerSubjectHandler{}, 0, 1)
+		configuration.CertFile = certFile
+		configuration.KeyFile = keyFile
+		configuration.ClientCAFile = test.clientCA
+
+		s, err := NewServer(configuration)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		go s.Serve(context.Background())
+
+		c, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "127.0.0.1",
+			Certificates: test.certificates,
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		line, err := bufio.NewReader(c).ReadString('\n')
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%s: Connection should be refused, Got:%q", test.name, line)
+			}
+		} else if err != nil || line != test.expected {
+			t.Errorf("%s: Expected:%q Got:%q %v", test.name, test.expected, line, err)
+		}
+
+		c.Close()
+		s.Shutdown(context.Background())
+	}
+}
+
+func TestTLSRejectSilentClient(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "packagetree-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey, _, _ := issueCertificate("packagetree-ca", nil, nil, t)
+	_, _, serverPEM, serverKeyPEM := issueCertificate("packagetree", ca, caKey, t)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientConfig := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+
+	configuration := NewServerConfiguration(&SlowConnectionHandler{}, 0, 1)
+	configuration.CertFile = writeFile(dir, "server.pem", serverPEM, t)
+	configuration.KeyFile = writeFile(dir, "server-key.pem", serverKeyPEM, t)
+	configuration.HerdPolicy = HERD_POLICY_REJECT
+	configuration.HandshakeTimeout = 500 * time.Millisecond
+
+	s, err := NewServer(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
+
+	first, err := tls.Dial("tcp", s.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	first.SetReadDeadline(time.Now().Add(3 * time.Second))
+	fmt.Fprintln(first, "QUERY|boo|")
+	if line, err := bufio.NewReader(first).ReadString('\n'); err != nil || line != "OK\n" {
+		t.Fatalf("Expected:%q Got:%q %v", "OK\n", line, err)
+	}
+
+	//Never sends a ClientHello, rejecting it must not hold up the connections behind it
+	silent, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	busy, err := tls.Dial("tcp", s.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	busy.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if line, err := bufio.NewReader(busy).ReadString('\n'); err != nil || line != DEFAULT_BUSY_NOTICE+"\n" {
+		t.Errorf("Expected:%q Got:%q %v", DEFAULT_BUSY_NOTICE+"\n", line, err)
+	}
+	if waited := time.Since(start); waited > configuration.HandshakeTimeout {
+		t.Errorf("Busy notice took %v behind a silent client, expected under:%v", waited, configuration.HandshakeTimeout)
+	}
+
+	silent.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := bufio.NewReader(silent).ReadString('\n'); err == nil {
+		t.Errorf("Silent client should be closed once the handshake timeout passes")
+	} else if e, ok := err.(net.Error); ok && e.Timeout() {
+		t.Errorf("Silent client was never closed")
+	}
+}
+
+func TestTLSConfigurationErrors(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		certFile string
+		keyFile  string
+		clientCA string
+	}{
+		{"missing certificate", "does-not-exist.pem", "does-not-exist-key.pem", ""},
+		{"client ca without certificate", "", "", "ca.pem"},
+	}
+
+	for _, test := range tests {
+		configuration := NewServerConfiguration(&MockConnectionHandler{}, 0, 1)
+		configuration.CertFile = test.certFile
+		configuration.KeyFile = test.keyFile
+		configuration.ClientCAFile = test.clientCA
+
+		s, err := NewServer(configuration)
+		if err == nil {
+			s.Shutdown(context.Background())
+			t.Errorf("%s: NewServer should fail", test.name)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/jrxfive/packagetree/pkg/graph"
+	"github.com/jrxfive/packagetree/pkg/logging"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	SNAPSHOT_FILE_NAME   string = "snapshot.json"
+	WAL_FILE_PREFIX      string = "wal-"
+	WAL_FILE_SUFFIX      string = ".log"
+	DEFAULT_COMPACT_SIZE int    = 1000
+
+	walAdd    = "ADD"
+	walRemove = "REMOVE"
+	walBatch  = "BATCH"
+)
+
+var logger = logging.GetLogger()
+
+//Single change recorded in the write-ahead log, one JSON document per line. A BATCH entry
+//holds the changes of a transaction in Entries so they are replayed all or not at all.
+type walEntry struct {
+	Op      string     `json:"op"`
+	Name    string     `json:"name,omitempty"`
+	Edges   []string   `json:"edges,omitempty"`
+	Entries []walEntry `json:"entries,omitempty"`
+}
+
+type snapshotPackage struct {
+	Name  string   `json:"name"`
+	Edges []string `json:"edges,omitempty"`
+}
+
+//Packages are stored in dependency order so they can be re-added one by one. Generation
+//names the write-ahead log that holds every change made after the snapshot was taken
+type snapshot struct {
+	Generation int               `json:"generation"`
+	Packages   []snapshotPackage `json:"packages"`
+}
+
+//Write-ahead log the backend appends to, an *os.File
+type logFile interface {
+	io.WriteSeeker
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+//Backend that keeps a TreeGraph in memory and persists every successful Add/Remove to an
+//append-only write-ahead log inside dir. Once compactSize entries have been logged the
+//graph is written to a snapshot and a new log is started. Changes made between Batch and
+//Flush are logged as a single entry. Like TreeGraph it is not go routine safe, the repository
+//manager is expected to handle locking.
+type DiskBackend struct {
+	*graph.TreeGraph
+	dir         string
+	generation  int
+	wal         logFile
+	walEntries  int
+	compactSize int
+	batching    bool
+	batched     []walEntry
+	restores    []func()
+}
+
+//Creates a DiskBackend rooted at dir, creating the directory when missing. The graph is
+//rebuilt from the latest snapshot followed by its write-ahead log. A compactSize below 1
+//disables compaction.
+func NewDiskBackend(dir string, compactSize int) (*DiskBackend, error) {
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	g, err := graph.NewGraph()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &DiskBackend{
+		TreeGraph:   g,
+		dir:         dir,
+		compactSize: compactSize,
+	}
+
+	err = b.recover()
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+//Adds name to the graph and logs the change, nothing is logged when the graph rejects it and
+//the graph is left unchanged when the change can't be logged. The names the dependencies
+//resolved to are logged rather than the specs so replaying the log binds the same versions.
+func (b *DiskBackend) Add(name string, edges ...string) error {
+
+	restore := b.restorer(name)
+
+	err := b.TreeGraph.Add(name, edges...)
+	if err != nil {
+		return err
+	}
+
+	resolved, _ := b.TreeGraph.Dependencies(name)
+	return b.log(walEntry{Op: walAdd, Name: name, Edges: resolved}, restore)
+}
+
+//Removes name from the graph and logs the change, removing an unknown name is not logged.
+//The graph is left unchanged when the change can't be logged.
+func (b *DiskBackend) Remove(name string) error {
+
+	if !b.Exists(name) {
+		return nil
+	}
+
+	restore := b.restorer(name)
+
+	err := b.TreeGraph.Remove(name)
+	if err != nil {
+		return err
+	}
+
+	return b.log(walEntry{Op: walRemove, Name: name}, restore)
+}
+
+//Holds back every change logged until Flush
+func (b *DiskBackend) Batch() {
+	b.batching = true
+	b.batched = nil
+	b.restores = nil
+}
+
+//Logs the changes held back since Batch as a single entry when committed, discards them
+//otherwise. When the entry can't be logged the graph is put back the way it was at Batch.
+func (b *DiskBackend) Flush(committed bool) error {
+
+	batched, restores := b.batched, b.restores
+	b.batching = false
+	b.batched = nil
+	b.restores = nil
+
+	if !committed || len(batched) == 0 {
+		return nil
+	}
+
+	err := b.append(walEntry{Op: walBatch, Entries: batched})
+	if err != nil {
+		for idx := len(restores) - 1; idx >= 0; idx-- {
+			restores[idx]()
+		}
+	}
+	return err
+}
+
+//Logs a change already made to the graph, restore undoes it when it can't be logged
+func (b *DiskBackend) log(entry walEntry, restore func()) error {
+
+	if b.batching {
+		b.batched = append(b.batched, entry)
+		b.restores = append(b.restores, restore)
+		return nil
+	}
+
+	err := b.append(entry)
+	if err != nil {
+		restore()
+	}
+	return err
+}
+
+//Returns a function putting name back the way it is now, undoing a change that couldn't be
+//logged. A removed package can always be re-added since nothing depended on it.
+func (b *DiskBackend) restorer(name string) func() {
+
+	if !b.Exists(name) {
+		return func() {
+			b.TreeGraph.Remove(name)
+		}
+	}
+
+	previous, _ := b.TreeGraph.Dependencies(name)
+	return func() {
+		err := b.TreeGraph.Add(name, previous...)
+		if err != nil {
+			logger.Printf("Failed to restore %s after a write-ahead log failure:%v\n", name, err)
+		}
+	}
+}
+
+//Writes the current graph to a new snapshot and starts an empty write-ahead log
+func (b *DiskBackend) Compact() error {
+
+	next := b.generation + 1
+	s := snapshot{
+		Generation: next,
+		Packages:   []snapshotPackage{},
+	}
+
+	b.Walk(func(name string, edges []string) error {
+		s.Packages = append(s.Packages, snapshotPackage{Name: name, Edges: edges})
+		return nil
+	})
+
+	wal, err := os.OpenFile(b.walPath(next), os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = writeSnapshot(filepath.Join(b.dir, SNAPSHOT_FILE_NAME), &s)
+	if err != nil {
+		wal.Close()
+		os.Remove(b.walPath(next))
+		return err
+	}
+
+	previous := b.generation
+	b.wal.Close()
+	b.wal = wal
+	b.walEntries = 0
+	b.generation = next
+
+	err = os.Remove(b.walPath(previous))
+	if err != nil && !os.IsNotExist(err) {
+		logger.Printf("Failed to remove compacted write-ahead log:%v\n", err)
+	}
+
+	return nil
+}
+
+//Closes the write-ahead log, the backend must not be used afterwards
+func (b *DiskBackend) Close() error {
+	return b.wal.Close()
+}
+
+//Appends entry to the write-ahead log and syncs it to disk, compacting once the log is full.
+//The log is left as it was when the entry can't be written.
+func (b *DiskBackend) append(entry walEntry) error {
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	//Logs are opened for appending, writes land at the end whatever the current offset is
+	offset, err := b.wal.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.wal.Write(append(line, '\n'))
+	if err == nil {
+		err = b.wal.Sync()
+	}
+	if err != nil {
+		//Drops whatever part of the entry was written so later entries don't follow it
+		b.wal.Truncate(offset)
+		return err
+	}
+
+	b.walEntries++
+	if b.compactSize > 0 && b.walEntries >= b.compactSize {
+		err = b.Compact()
+		if err != nil {
+			logger.Printf("Failed to compact write-ahead log:%v\n", err)
+		}
+	}
+
+	return nil
+}
+
+//Loads the snapshot, replays its write-ahead log and opens the log for appending. Logs
+//left behind by an interrupted compaction are removed
+func (b *DiskBackend) recover() error {
+
+	s, err := readSnapshot(filepath.Join(b.dir, SNAPSHOT_FILE_NAME))
+	if err != nil {
+		return err
+	}
+
+	b.generation = s.Generation
+	for _, p := range s.Packages {
+		err = b.TreeGraph.Add(p.Name, p.Edges...)
+		if err != nil {
+			return fmt.Errorf("Corrupt snapshot package:%s %v", p.Name, err)
+		}
+	}
+
+	entries, err := b.replay(b.walPath(b.generation))
+	if err != nil {
+		return err
+	}
+
+	b.removeStaleLogs()
+
+	b.wal, err = os.OpenFile(b.walPath(b.generation), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	b.walEntries = entries
+
+	return nil
+}
+
+//Applies every entry of the write-ahead log at path to the graph. A final line without a
+//newline is the remains of an interrupted write and is discarded along with the bytes
+//after the last complete entry
+func (b *DiskBackend) replay(path string) (int, error) {
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var entries int
+	var offset int64
+	reader := bufio.NewReader(f)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				logger.Printf("Discarding incomplete write-ahead log entry in:%s\n", path)
+				return entries, f.Truncate(offset)
+			}
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+
+		var entry walEntry
+		err = json.Unmarshal(line, &entry)
+		if err != nil {
+			return entries, fmt.Errorf("Corrupt write-ahead log entry:%d %v", entries+1, err)
+		}
+
+		err = b.apply(entry)
+		if err != nil {
+			return entries, fmt.Errorf("Failed to replay write-ahead log entry:%d %v", entries+1, err)
+		}
+
+		entries++
+		offset += int64(len(line))
+	}
+}
+
+//Applies a single write-ahead log entry to the graph
+func (b *DiskBackend) apply(entry walEntry) error {
+
+	switch entry.Op {
+	case walAdd:
+		return b.TreeGraph.Add(entry.Name, entry.Edges...)
+	case walRemove:
+		return b.TreeGraph.Remove(entry.Name)
+	case walBatch:
+		for _, e := range entry.Entries {
+			err := b.apply(e)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unknown operation:%s", entry.Op)
+	}
+}
+
+//Removes write-ahead logs that belong to a generation other than the current one
+func (b *DiskBackend) removeStaleLogs() {
+
+	matches, err := filepath.Glob(filepath.Join(b.dir, WAL_FILE_PREFIX+"*"+WAL_FILE_SUFFIX))
+	if err != nil {
+		return
+	}
+
+	for _, match := range matches {
+		base := filepath.Base(match)
+		generation, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(base, WAL_FILE_PREFIX), WAL_FILE_SUFFIX))
+		if err != nil || generation == b.generation {
+			continue
+		}
+
+		err = os.Remove(match)
+		if err != nil {
+			logger.Printf("Failed to remove stale write-ahead log:%v\n", err)
+		}
+	}
+}
+
+func (b *DiskBackend) walPath(generation int) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%s%d%s", WAL_FILE_PREFIX, generation, WAL_FILE_SUFFIX))
+}
+
+//Reads the snapshot at path, a missing snapshot is an empty generation zero graph
+func readSnapshot(path string) (*snapshot, error) {
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &snapshot{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var s snapshot
+	err = json.NewDecoder(f).Decode(&s)
+	if err != nil {
+		return nil, fmt.Errorf("Corrupt snapshot:%s %v", path, err)
+	}
+
+	return &s, nil
+}
+
+//Writes the snapshot to a temporary file and renames it over path so a crash never
+//leaves a partially written snapshot behind
+func writeSnapshot(path string, s *snapshot) error {
+
+	temp := path + ".tmp"
+	f, err := os.OpenFile(temp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(f).Encode(s)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	return os.Rename(temp, path)
+}
@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "packagetree")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func newDiskBackend(dir string, compactSize int, t *testing.T) *DiskBackend {
+	b, err := NewDiskBackend(dir, compactSize)
+	if err != nil {
+		t.Fatalf("Failed to create disk backend:%v", err)
+	}
+
+	return b
+}
+
+func TestRecover(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	b := newDiskBackend(dir, 0, t)
+	b.Add("gmp")
+	b.Add("isl", "gmp")
+	b.Add("cloog", "gmp", "isl")
+	b.Add("boo", "missing")
+	b.Remove("cloog")
+	b.Remove("gmp")
+	b.Close()
+
+	b = newDiskBackend(dir, 0, t)
+	defer b.Close()
+
+	var tests = []struct {
+		name   string
+		exists bool
+	}{
+		{"gmp", true},
+		{"isl", true},
+		{"cloog", false},
+		{"boo", false},
+	}
+
+	for _, test := range tests {
+		if exists := b.Exists(test.name); exists != test.exists {
+			t.Errorf("Exists(%q) = %v, expected:%v", test.name, exists, test.exists)
+		}
+	}
+
+	if err := b.Remove("gmp"); err == nil {
+		t.Errorf("Remove(%q) should fail, isl depends on gmp after recovery", "gmp")
+	}
+}
+
+func TestRecoverResolvedDependencies(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	//1 and 1.0 compare equal, c keeps the version it was bound to after the other is re-added
+	b := newDiskBackend(dir, 0, t)
+	b.Add("libfoo@1.0")
+	b.Add("libfoo@1")
+	b.Add("c", "libfoo=1")
+
+	bound, _ := b.Dependencies("c")
+	other := "libfoo@1"
+	if strings.Join(bound, ",") == other {
+		other = "libfoo@1.0"
+	}
+	b.Remove(other)
+	b.Add(other)
+	b.Add("app", "libfoo>=1,<2")
+	b.Close()
+
+	f, err := ioutil.ReadFile(b.walPath(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(f), "libfoo=1") || strings.Contains(string(f), "libfoo>=1") {
+		t.Errorf("Write-ahead log should hold resolved dependencies, got:%s", f)
+	}
+
+	b, err = NewDiskBackend(dir, 0)
+	if err != nil {
+		t.Fatalf("Failed to recover:%v", err)
+	}
+	defer b.Close()
+
+	if dependencies, _ := b.Dependencies("c"); strings.Join(dependencies, ",") != strings.Join(bound, ",") {
+		t.Errorf("Dependencies(c) after recovery = %v, expected:%v", dependencies, bound)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	b := newDiskBackend(dir, 0, t)
+	b.Add("gmp")
+
+	//Committed, logged as one entry
+	b.Batch()
+	b.Add("isl", "gmp")
+	b.Add("cloog", "gmp", "isl")
+	if err := b.Flush(true); err != nil {
+		t.Fatalf("Flush(true) = %v, expected:nil", err)
+	}
+
+	//Undone, nothing is logged
+	b.Batch()
+	b.Add("ppl", "gmp")
+	b.Remove("ppl")
+	b.Flush(false)
+
+	//Failing to log the batch puts the graph back
+	wal := b.wal
+	b.wal = &failingLog{logFile: wal}
+	b.Batch()
+	b.Remove("cloog")
+	b.Add("isl")
+	b.Add("mpc", "gmp")
+	if err := b.Flush(true); err == nil {
+		t.Errorf("Flush(true) should fail once the write-ahead log fails")
+	}
+	b.wal = wal
+
+	if dependencies, _ := b.Dependencies("isl"); !b.Exists("cloog") || b.Exists("mpc") || strings.Join(dependencies, ",") != "gmp" {
+		t.Errorf("Failed batch should be undone, cloog:%v mpc:%v isl:%v", b.Exists("cloog"), b.Exists("mpc"), dependencies)
+	}
+
+	//Interrupted before Flush, nothing is logged
+	b.Batch()
+	b.Add("gcc", "gmp")
+	b.Remove("cloog")
+	b.Close()
+
+	f, err := ioutil.ReadFile(b.walPath(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(f), "\n"); lines != 2 {
+		t.Errorf("Write-ahead log has %d entries, expected:2 %s", lines, f)
+	}
+
+	b = newDiskBackend(dir, 0, t)
+	defer b.Close()
+
+	var tests = []struct {
+		name   string
+		exists bool
+	}{
+		{"gmp", true},
+		{"isl", true},
+		{"cloog", true},
+		{"ppl", false},
+		{"mpc", false},
+		{"gcc", false},
+	}
+
+	for _, test := range tests {
+		if exists := b.Exists(test.name); exists != test.exists {
+			t.Errorf("Exists(%q) after recovery = %v, expected:%v", test.name, exists, test.exists)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	b := newDiskBackend(dir, 2, t)
+	b.Add("gmp")
+	b.Add("isl", "gmp")
+	b.Add("cloog", "gmp", "isl")
+	b.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, SNAPSHOT_FILE_NAME)); err != nil {
+		t.Fatalf("Snapshot should exist after compaction:%v", err)
+	}
+
+	if _, err := os.Stat(b.walPath(0)); !os.IsNotExist(err) {
+		t.Errorf("Compacted write-ahead log should be removed:%v", err)
+	}
+
+	b = newDiskBackend(dir, 2, t)
+	defer b.Close()
+
+	for _, name := range []string{"gmp", "isl", "cloog"} {
+		if !b.Exists(name) {
+			t.Errorf("Exists(%q) = false after compaction", name)
+		}
+	}
+
+	if b.walEntries != 1 {
+		t.Errorf("Expected 1 entry in write-ahead log after compaction, got:%d", b.walEntries)
+	}
+}
+
+func TestRecoverIncompleteEntry(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	b := newDiskBackend(dir, 0, t)
+	b.Add("gmp")
+	b.Close()
+
+	f, err := os.OpenFile(b.walPath(0), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"ADD","name":"is`)
+	f.Close()
+
+	b = newDiskBackend(dir, 0, t)
+	b.Add("isl", "gmp")
+	b.Close()
+
+	b = newDiskBackend(dir, 0, t)
+	defer b.Close()
+
+	if !b.Exists("gmp") || !b.Exists("isl") {
+		t.Errorf("Entries around an incomplete write should be recovered")
+	}
+}
+
+func TestLogFailure(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	b := newDiskBackend(dir, 0, t)
+	b.Add("gmp")
+	b.Add("isl", "gmp")
+	b.Add("boo")
+	b.Close()
+
+	//Every following append writes part of its entry and fails, after a restart so the log
+	//was reopened with entries in it
+	b = newDiskBackend(dir, 0, t)
+	wal := b.wal
+	b.wal = &failingLog{logFile: wal}
+
+	var changes = []struct {
+		name   string
+		change func() error
+	}{
+		{"add new", func() error { return b.Add("cloog", "gmp", "isl") }},
+		{"re-add", func() error { return b.Add("isl") }},
+		{"remove", func() error { return b.Remove("boo") }},
+	}
+
+	for _, change := range changes {
+		if err := change.change(); err == nil {
+			t.Errorf("%s: should fail once the write-ahead log is closed", change.name)
+		}
+	}
+
+	var tests = []struct {
+		name         string
+		exists       bool
+		dependencies string
+	}{
+		{"cloog", false, ""},
+		{"isl", true, "gmp"},
+		{"boo", true, ""},
+	}
+
+	for _, test := range tests {
+		if exists := b.Exists(test.name); exists != test.exists {
+			t.Errorf("Exists(%q) = %v, expected:%v", test.name, exists, test.exists)
+		}
+		if !test.exists {
+			continue
+		}
+		if dependencies, err := b.Dependencies(test.name); err != nil || strings.Join(dependencies, ",") != test.dependencies {
+			t.Errorf("Dependencies(%q) = %v %v, expected:%s", test.name, dependencies, err, test.dependencies)
+		}
+	}
+
+	if err := b.Remove("gmp"); err == nil {
+		t.Errorf("Remove(%q) should fail, isl still depends on gmp", "gmp")
+	}
+
+	//The log keeps every entry written before the failures and can be appended to again
+	b.wal = wal
+	if err := b.Add("ppl", "gmp"); err != nil {
+		t.Fatalf("Add(%q) = %v, expected:nil", "ppl", err)
+	}
+	b.Close()
+
+	b = newDiskBackend(dir, 0, t)
+	defer b.Close()
+
+	for _, name := range []string{"gmp", "isl", "boo", "ppl"} {
+		if !b.Exists(name) {
+			t.Errorf("Exists(%q) = false after a restart", name)
+		}
+	}
+	if b.Exists("cloog") {
+		t.Errorf("Exists(%q) = true after a restart, its entry failed", "cloog")
+	}
+}
+
+//Writes half of every entry and fails
+type failingLog struct {
+	logFile
+}
+
+func (l *failingLog) Write(p []byte) (int, error) {
+	n, _ := l.logFile.Write(p[:len(p)/2])
+	return n, errors.New("Write failed")
+}